@@ -0,0 +1,553 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"math/bits"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	ReportVerifierNone = "none"
+	ReportVerifierPoW  = "pow"
+	ReportVerifierStub = "stub"
+)
+
+const (
+	defaultPoWDifficulty = 18
+	powChallengeTTL      = time.Hour
+	// The stub verifier accepts this proof only, for tests and local development
+	stubVerifierProof = "pass"
+)
+
+// Finders may send a few reports per quarter of an hour, pets may receive a few dozens per hour
+var (
+	reportIPLimiter  = newRateLimiter(5, 15*time.Minute)
+	reportPetLimiter = newRateLimiter(30, time.Hour)
+)
+
+// rateLimiter allows limit hits per key over a sliding window, in memory
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+	calls  int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, hits: make(map[string][]time.Time)}
+}
+
+// Allow records a hit for the key, or returns how long to wait when the limit is reached
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.calls++
+	if l.calls%1000 == 0 {
+		l.sweep(now)
+	}
+
+	hits := l.hits[key]
+	for len(hits) > 0 && now.Sub(hits[0]) >= l.window {
+		hits = hits[1:]
+	}
+
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false, l.window - now.Sub(hits[0])
+	}
+
+	l.hits[key] = append(hits, now)
+	return true, 0
+}
+
+// sweep forgets the keys without recent hits
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, hits := range l.hits {
+		if len(hits) == 0 || now.Sub(hits[len(hits)-1]) >= l.window {
+			delete(l.hits, key)
+		}
+	}
+}
+
+// HumanVerifier checks the proof a finder sends with a report that a human, or at least some work, is behind it
+type HumanVerifier interface {
+	// Challenge is sent to the finder with the public pet, nil when there is nothing to solve
+	Challenge() *VerifierChallenge
+	// Verify gets back the nonce of the challenge along with the finder's proof
+	Verify(nonce string, proof string) error
+}
+
+type VerifierChallenge struct {
+	Kind       string `json:"kind"`
+	Nonce      string `json:"nonce,omitempty"`
+	Difficulty int    `json:"difficulty,omitempty"`
+}
+
+// reportVerifier is the verifier configured at startup
+var reportVerifier HumanVerifier = noVerifier{}
+
+func loadReportVerifier() HumanVerifier {
+	switch os.Getenv("REPORT_VERIFIER") {
+	case ReportVerifierPoW:
+		difficulty, err := strconv.Atoi(os.Getenv("REPORT_POW_DIFFICULTY"))
+		if err != nil || difficulty < 1 || difficulty > 32 {
+			difficulty = defaultPoWDifficulty
+		}
+		return newPoWVerifier(difficulty, getJWTSecret())
+	case ReportVerifierStub:
+		return stubVerifier{}
+	}
+
+	return noVerifier{}
+}
+
+type noVerifier struct{}
+
+func (noVerifier) Challenge() *VerifierChallenge {
+	return nil
+}
+
+func (noVerifier) Verify(nonce string, proof string) error {
+	return nil
+}
+
+type stubVerifier struct{}
+
+func (stubVerifier) Challenge() *VerifierChallenge {
+	return &VerifierChallenge{Kind: ReportVerifierStub}
+}
+
+func (stubVerifier) Verify(nonce string, proof string) error {
+	if proof != stubVerifierProof {
+		return fmt.Errorf("Vérification anti-spam échouée")
+	}
+
+	return nil
+}
+
+// powVerifier asks for a proof such that sha256("nonce:proof") starts with Difficulty zero bits.
+// Nonces are signed by the server, expire and are accepted once, so a solved proof can't be replayed.
+type powVerifier struct {
+	Difficulty int
+	secret     []byte
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func newPoWVerifier(difficulty int, secret []byte) *powVerifier {
+	return &powVerifier{Difficulty: difficulty, secret: secret, used: make(map[string]time.Time)}
+}
+
+func (v *powVerifier) sign(payload string) string {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Challenge hands out a nonce made of random bytes and an expiry, signed by the server
+func (v *powVerifier) Challenge() *VerifierChallenge {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return &VerifierChallenge{Kind: ReportVerifierPoW, Difficulty: v.Difficulty}
+	}
+
+	payload := fmt.Sprintf("%s.%d", hex.EncodeToString(random), time.Now().Add(powChallengeTTL).Unix())
+	return &VerifierChallenge{
+		Kind:       ReportVerifierPoW,
+		Nonce:      payload + "." + v.sign(payload),
+		Difficulty: v.Difficulty,
+	}
+}
+
+func (v *powVerifier) Verify(nonce string, proof string) error {
+	failed := fmt.Errorf("Vérification anti-spam échouée")
+	if proof == "" || len(proof) > 64 {
+		return failed
+	}
+
+	parts := strings.Split(nonce, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(v.sign(parts[0]+"."+parts[1]))) {
+		return failed
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return fmt.Errorf("Le défi anti-spam a expiré, rechargez la page")
+	}
+
+	sum := sha256.Sum256([]byte(nonce + ":" + proof))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	if zeros < v.Difficulty {
+		return failed
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	for used, expiresAt := range v.used {
+		if now.After(expiresAt) {
+			delete(v.used, used)
+		}
+	}
+	if _, ok := v.used[nonce]; ok {
+		return fmt.Errorf("Ce défi anti-spam a déjà été utilisé")
+	}
+	v.used[nonce] = time.Unix(expiry, 0)
+
+	return nil
+}
+
+var (
+	spamLinkPattern  = regexp.MustCompile(`(?i)(https?://|www\.|\.(com|net|ru|xyz|top)\b)`)
+	spamWordsPattern = regexp.MustCompile(`(?i)\b(casino|viagra|cialis|bitcoin|crypto|forex|loan|seo|porn)\b`)
+)
+
+// looksLikeSpam flags reports with links, advertising words, long repeated characters or shouting
+func looksLikeSpam(report *Report) bool {
+	text := strings.Join([]string{report.Additional, report.Where, report.City}, " ")
+	if spamLinkPattern.MatchString(text) || spamWordsPattern.MatchString(text) {
+		return true
+	}
+
+	// Go's regexp has no back-references, runs of a character are counted by hand
+	run, previous := 0, rune(0)
+	letters, upper := 0, 0
+	for _, c := range text {
+		if c == previous {
+			run++
+			if run >= 10 {
+				return true
+			}
+		} else {
+			run, previous = 1, c
+		}
+		if unicode.IsLetter(c) {
+			letters++
+			if unicode.IsUpper(c) {
+				upper++
+			}
+		}
+	}
+
+	return letters >= 20 && upper*10 >= letters*8
+}
+
+// reporterFingerprint identifies a reporter without storing the IP address
+func reporterFingerprint(r *http.Request) string {
+	return hashIP(clientIP(r))
+}
+
+// ReporterBlock stops a fingerprint from reporting, for the pets of one owner or everywhere when set by an admin
+type ReporterBlock struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Fingerprint string    `gorm:"type:varchar(64);index" json:"fingerprint"`
+	UserID      *uint     `gorm:"index" json:"user_id"`
+	Reason      string    `gorm:"type:varchar(255)" json:"reason"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type ReporterBlockRequest struct {
+	Fingerprint string `json:"fingerprint"`
+	Reason      string `json:"reason"`
+}
+
+func (rbr *ReporterBlockRequest) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	if len(rbr.Fingerprint) != 64 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "fingerprint",
+			Error: "Empreinte invalide",
+		})
+	}
+	if len(rbr.Reason) > 255 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "reason",
+			Error: "La raison ne doit pas dépasser 255 caractères",
+		})
+	}
+
+	return fieldErr
+}
+
+func isBlockedReporter(fingerprint string, ownerID uint) bool {
+	var count int64
+	db.Model(&ReporterBlock{}).
+		Where("fingerprint = ?", fingerprint).
+		Where("user_id IS NULL OR user_id = ?", ownerID).
+		Count(&count)
+
+	return count > 0
+}
+
+// respondTooManyRequests tells the client when to retry
+func respondTooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	response := HTTPResponse{
+		Error: FieldErrors{
+			{
+				Field: "-",
+				Error: "Trop de signalements, réessayez plus tard",
+			},
+		},
+		Status: http.StatusTooManyRequests,
+	}
+	RespondJson(w, r, response)
+}
+
+// isAdmin only lets administrators through
+func isAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := currentUserID(r)
+		var user User
+		if err == nil {
+			err = db.First(&user, userID).Error
+		}
+		if err != nil || !user.IsAdmin {
+			response := HTTPResponse{
+				Error: FieldErrors{
+					{
+						Field: "-",
+						Error: "Accès réservé aux administrateurs",
+					},
+				},
+				Status: http.StatusForbidden,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BlockReporter lets the owner block the author of one of their reports, the report being marked as spam
+func BlockReporter(w http.ResponseWriter, r *http.Request) {
+	report, status, errors := userReport(r)
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if report.Fingerprint == "" {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "L'auteur de ce signalement ne peut pas être bloqué",
+				},
+			},
+			Status: http.StatusConflict,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var pet Pet
+	block := ReporterBlock{Fingerprint: report.Fingerprint, Reason: fmt.Sprintf("Signalement %d", report.ID)}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&pet, report.PetID).Error; err != nil {
+			return err
+		}
+		block.UserID = &pet.UserID
+		if err := tx.Create(&block).Error; err != nil {
+			return err
+		}
+
+		if report.Status == ReportStatusSpam || !canMoveReport(report.Status, ReportStatusSpam) {
+			return nil
+		}
+		return changeReportStatus(tx, report, ReportStatusSpam)
+	})
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   block,
+		Error:  nil,
+		Status: http.StatusCreated,
+	}
+	RespondJson(w, r, response)
+}
+
+// GetReporterBlocks lists the owner's blocks, or every global block for admins
+func GetReporterBlocks(w http.ResponseWriter, r *http.Request) {
+	query := db.Where("user_id IS NULL")
+	if !strings.HasPrefix(r.URL.Path, "/admin/") {
+		userID, err := currentUserID(r)
+		if err != nil {
+			response := HTTPResponse{
+				Error: FieldErrors{
+					{
+						Field: "jwt",
+						Error: err.Error(),
+					},
+				},
+				Status: http.StatusUnauthorized,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+		query = db.Where("user_id = ?", userID)
+	}
+
+	var blocks []ReporterBlock
+	query.Order("created_at desc").Find(&blocks)
+
+	response := HTTPResponse{
+		Data:   blocks,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+// CreateGlobalReporterBlock blocks a fingerprint on every pet
+func CreateGlobalReporterBlock(w http.ResponseWriter, r *http.Request) {
+	var blockRequest ReporterBlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&blockRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if errors := blockRequest.Validate(); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   blockRequest,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	block := ReporterBlock{Fingerprint: blockRequest.Fingerprint, Reason: blockRequest.Reason}
+	if err := db.Create(&block).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   block,
+		Error:  nil,
+		Status: http.StatusCreated,
+	}
+	RespondJson(w, r, response)
+}
+
+// DeleteReporterBlock lifts a block of the owner, or a global block for admins
+func DeleteReporterBlock(w http.ResponseWriter, r *http.Request) {
+	blockID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Identifiant de blocage invalide",
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	query := db.Where("user_id IS NULL")
+	if !strings.HasPrefix(r.URL.Path, "/admin/") {
+		userID, err := currentUserID(r)
+		if err != nil {
+			response := HTTPResponse{
+				Error: FieldErrors{
+					{
+						Field: "jwt",
+						Error: err.Error(),
+					},
+				},
+				Status: http.StatusUnauthorized,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+		query = db.Where("user_id = ?", userID)
+	}
+
+	result := query.Where("id = ?", blockID).Delete(&ReporterBlock{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Blocage introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   nil,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
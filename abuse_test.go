@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/gorilla/mux"
+	"math/bits"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter(2, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("hit %d refused under the limit", i+1)
+		}
+	}
+	ok, retryAfter := limiter.Allow("a")
+	if ok {
+		t.Fatal("third hit allowed over the limit")
+	}
+	if retryAfter <= 0 || retryAfter > 50*time.Millisecond {
+		t.Errorf("retry after %s, want within the window", retryAfter)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("keys must be limited separately")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("the window should have slid past the old hits")
+	}
+}
+
+func TestLooksLikeSpam(t *testing.T) {
+	tests := []struct {
+		name   string
+		report Report
+		spam   bool
+	}{
+		{"plain report", Report{City: "Lyon", Where: "Près du parc", Additional: "Il a l'air en bonne santé, je l'ai mis à l'abri."}, false},
+		{"link", Report{Additional: "Voir https://example.com pour le récupérer"}, true},
+		{"spam words", Report{Additional: "Casino en ligne, gagnez vite"}, true},
+		{"repeated characters", Report{Additional: "!!!!!!!!!!!!"}, true},
+		{"shouting", Report{Additional: "APPELEZ MOI VITE POUR VOTRE CHIEN"}, true},
+		{"short capitals", Report{City: "LYON"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := looksLikeSpam(&test.report); got != test.spam {
+				t.Errorf("looksLikeSpam = %v, want %v", got, test.spam)
+			}
+		})
+	}
+}
+
+func TestCreateReportHoneypot(t *testing.T) {
+	openTestDB(t, &Report{}, &ReportPhoto{})
+	t.Setenv("SCAN_IP_SALT", "salt")
+
+	previous := reportIPLimiter
+	reportIPLimiter = newRateLimiter(5, time.Minute)
+	defer func() { reportIPLimiter = previous }()
+
+	body := `{"city":"Lyon","where":"Parc","phone_number":"0612345678","website":"https://spam.example"}`
+	r := httptest.NewRequest(http.MethodPost, "/pets/rex/reports", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r = mux.SetURLVars(r, map[string]string{"slug": "rex"})
+	r = r.WithContext(context.WithValue(r.Context(), "requestID", "test"))
+	w := httptest.NewRecorder()
+
+	CreateReport(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Errorf("status %d, want a fake %d", w.Code, http.StatusCreated)
+	}
+	var count int64
+	db.Model(&Report{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d reports stored, want the honeypot to drop it", count)
+	}
+}
+
+func TestStubVerifier(t *testing.T) {
+	verifier := stubVerifier{}
+	if challenge := verifier.Challenge(); challenge == nil || challenge.Kind != ReportVerifierStub {
+		t.Errorf("unexpected challenge %+v", challenge)
+	}
+	if err := verifier.Verify("", stubVerifierProof); err != nil {
+		t.Errorf("the stub proof was refused: %v", err)
+	}
+	if err := verifier.Verify("", "fail"); err == nil {
+		t.Error("a wrong proof was accepted")
+	}
+}
+
+// solvePoW finds a proof for the nonce by brute force, fine at a low difficulty
+func solvePoW(t *testing.T, nonce string, difficulty int) string {
+	t.Helper()
+
+	for i := 0; i < 1<<20; i++ {
+		proof := fmt.Sprint(i)
+		sum := sha256.Sum256([]byte(nonce + ":" + proof))
+		zeros := 0
+		for _, b := range sum {
+			zeros += bits.LeadingZeros8(b)
+			if b != 0 {
+				break
+			}
+		}
+		if zeros >= difficulty {
+			return proof
+		}
+	}
+
+	t.Fatal("no proof found")
+	return ""
+}
+
+func TestPoWVerifier(t *testing.T) {
+	verifier := newPoWVerifier(8, []byte("secret"))
+
+	challenge := verifier.Challenge()
+	if challenge.Kind != ReportVerifierPoW || challenge.Difficulty != 8 || challenge.Nonce == "" {
+		t.Fatalf("unexpected challenge %+v", challenge)
+	}
+	proof := solvePoW(t, challenge.Nonce, 8)
+
+	// Same secret, but a proof of 8 bits almost never holds 30
+	if err := newPoWVerifier(30, []byte("secret")).Verify(challenge.Nonce, proof); err == nil {
+		t.Error("a proof short of the difficulty was accepted")
+	}
+	if err := verifier.Verify(challenge.Nonce, proof); err != nil {
+		t.Fatalf("a solved challenge was refused: %v", err)
+	}
+	if err := verifier.Verify(challenge.Nonce, proof); err == nil {
+		t.Error("a solved challenge was accepted twice")
+	}
+
+	// A nonce the server didn't sign, or signed by another secret
+	forged := verifier.Challenge().Nonce
+	if forged[0] == '0' {
+		forged = "1" + forged[1:]
+	} else {
+		forged = "0" + forged[1:]
+	}
+	if err := verifier.Verify(forged, solvePoW(t, forged, 8)); err == nil {
+		t.Error("a tampered nonce was accepted")
+	}
+	other := newPoWVerifier(8, []byte("other")).Challenge().Nonce
+	if err := verifier.Verify(other, solvePoW(t, other, 8)); err == nil {
+		t.Error("a nonce signed by another secret was accepted")
+	}
+
+	payload := fmt.Sprintf("abcd.%d", time.Now().Add(-time.Minute).Unix())
+	expired := payload + "." + verifier.sign(payload)
+	if err := verifier.Verify(expired, solvePoW(t, expired, 8)); err == nil {
+		t.Error("an expired nonce was accepted")
+	}
+}
+
+func TestCreateReportWithoutBearerToken(t *testing.T) {
+	t.Setenv("SCAN_IP_SALT", "salt")
+
+	previous := reportIPLimiter
+	reportIPLimiter = newRateLimiter(5, time.Minute)
+	defer func() { reportIPLimiter = previous }()
+
+	for _, authorization := range []string{"", "Basic dXNlcjpwYXNz", "Bearer "} {
+		body := `{"city":"Lyon","where":"Parc","phone_number":"0612345678"}`
+		r := httptest.NewRequest(http.MethodPost, "/pet/rex/report", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		r = mux.SetURLVars(r, map[string]string{"slug": "rex"})
+		r = r.WithContext(context.WithValue(r.Context(), "requestID", "test"))
+		w := httptest.NewRecorder()
+
+		CreateReport(w, r)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q answered %d, want %d", authorization, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestDeleteReporterBlockOnlyTakesNumericIDs(t *testing.T) {
+	openTestDB(t, &ReporterBlock{})
+	t.Setenv("JWT_SECRET_KEY", "secret")
+	token, err := generateJWT(&User{ID: 1, Email: "owner@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner, other := uint(1), uint(2)
+	db.Create(&ReporterBlock{Fingerprint: "own", UserID: &owner})
+	db.Create(&ReporterBlock{Fingerprint: "other", UserID: &other})
+	db.Create(&ReporterBlock{Fingerprint: "global"})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/user/blocks/{id}", DeleteReporterBlock).Methods("DELETE")
+	remove := func(id string) int {
+		r := httptest.NewRequest(http.MethodDelete, "/user/blocks/"+id, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := remove("1=1)%20OR%20(1=1"); code != http.StatusBadRequest {
+		t.Errorf("an injected id answered %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := remove("2"); code != http.StatusNotFound {
+		t.Errorf("another owner's block answered %d, want %d", code, http.StatusNotFound)
+	}
+	if code := remove("1"); code != http.StatusOK {
+		t.Errorf("the owner's block answered %d, want %d", code, http.StatusOK)
+	}
+
+	var left int64
+	db.Model(&ReporterBlock{}).Count(&left)
+	if left != 2 {
+		t.Errorf("%d blocks left, want the other owner's and the global one", left)
+	}
+}
+
+func TestCreateReportChecksTokenBeforePhotos(t *testing.T) {
+	t.Setenv("SCAN_IP_SALT", "salt")
+
+	previous := reportIPLimiter
+	reportIPLimiter = newRateLimiter(5, time.Minute)
+	defer func() { reportIPLimiter = previous }()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("report", `{"city":"Lyon","where":"Parc","phone_number":"0612345678"}`)
+	part, _ := form.CreateFormFile("photos", "dog.jpg")
+	part.Write([]byte("not an image"))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/pet/rex/report", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = mux.SetURLVars(r, map[string]string{"slug": "rex"})
+	r = r.WithContext(context.WithValue(r.Context(), "requestID", "test"))
+	w := httptest.NewRecorder()
+
+	CreateReport(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("answered %d, want %d before looking at the photos", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestCreateReportRefusesUserToken(t *testing.T) {
+	t.Setenv("SCAN_IP_SALT", "salt")
+	t.Setenv("JWT_SECRET_KEY", "secret")
+	token, err := generateJWT(&User{ID: 1, Email: "owner@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := reportIPLimiter
+	reportIPLimiter = newRateLimiter(5, time.Minute)
+	defer func() { reportIPLimiter = previous }()
+
+	body := `{"city":"Lyon","where":"Parc","phone_number":"0612345678"}`
+	r := httptest.NewRequest(http.MethodPost, "/pet/rex/report", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+	r = mux.SetURLVars(r, map[string]string{"slug": "rex"})
+	r = r.WithContext(context.WithValue(r.Context(), "requestID", "test"))
+	w := httptest.NewRecorder()
+
+	CreateReport(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a user token answered %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"math"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultAlertRadius = 5000
+	maxAlertRadius     = 50000
+	// A neighbour gets at most one lost pet alert during this interval
+	alertThrottle = 6 * time.Hour
+)
+
+// AlertSubscription is the home area of a user who wants to hear about pets lost nearby
+type AlertSubscription struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	UserID           uint       `gorm:"uniqueIndex" json:"-"`
+	Latitude         float64    `gorm:"index" json:"latitude"`
+	Longitude        float64    `json:"longitude"`
+	RadiusMeters     int        `json:"radius_meters"`
+	Channel          string     `gorm:"type:varchar(10)" json:"channel"`
+	Active           bool       `json:"active"`
+	UnsubscribeToken string     `gorm:"type:varchar(64);uniqueIndex" json:"-"`
+	LastAlertAt      *time.Time `json:"last_alert_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+type AlertSubscriptionRequest struct {
+	Latitude     *float64 `json:"latitude"`
+	Longitude    *float64 `json:"longitude"`
+	RadiusMeters int      `json:"radius_meters"`
+	Channel      string   `json:"channel"`
+}
+
+// LostAlertNotification is what neighbours learn about a lost pet, within the limits of its privacy settings
+type LostAlertNotification struct {
+	Pet               PublicPet `json:"pet"`
+	LastSeenLocation  string    `json:"last_seen_location,omitempty"`
+	LastSeenLatitude  float64   `json:"last_seen_latitude"`
+	LastSeenLongitude float64   `json:"last_seen_longitude"`
+	DistanceMeters    int       `json:"distance_meters"`
+	URL               string    `json:"url"`
+	PhotoURL          string    `json:"photo_url,omitempty"`
+	UnsubscribeURL    string    `json:"unsubscribe_url"`
+}
+
+func (asr *AlertSubscriptionRequest) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	if asr.Latitude == nil || asr.Longitude == nil {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "latitude",
+			Error: "La position de votre quartier est obligatoire",
+		})
+	} else {
+		fieldErr = append(fieldErr, validateCoordinates(asr.Latitude, asr.Longitude, nil)...)
+	}
+
+	if asr.RadiusMeters == 0 {
+		asr.RadiusMeters = defaultAlertRadius
+	}
+	if asr.RadiusMeters < 100 || asr.RadiusMeters > maxAlertRadius {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "radius_meters",
+			Error: fmt.Sprintf("Le rayon doit être compris entre 100 et %d mètres", maxAlertRadius),
+		})
+	}
+
+	if asr.Channel == "" {
+		asr.Channel = NotificationChannelEmail
+	}
+	if asr.Channel != NotificationChannelEmail && asr.Channel != NotificationChannelSMS && asr.Channel != NotificationChannelWebhook {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "channel",
+			Error: fmt.Sprintf("Canal inconnu : %s", asr.Channel),
+		})
+	}
+
+	return fieldErr
+}
+
+func alertUnsubscribeURL(token string) string {
+	return fmt.Sprintf("%s/alerts/unsubscribe/%s", os.Getenv("FRONTEND_URL"), token)
+}
+
+// alertPetTag is the tag whose public page the alert links to: the primary one, or else any active tag
+func alertPetTag(pet *Pet) (*QRCode, error) {
+	var tag QRCode
+	err := db.Where("id = ? AND status = ?", pet.QRCodeID, TagStatusActive).First(&tag).Error
+	if err == gorm.ErrRecordNotFound {
+		err = db.Where("pet_id = ? AND status = ?", pet.ID, TagStatusActive).Order("id").First(&tag).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &tag, nil
+}
+
+// alertPreferences only enables the channel chosen for alerts, webhooks keeping the user's endpoint
+func alertPreferences(subscription *AlertSubscription) (NotificationPreference, error) {
+	preferences, err := userNotificationPreference(subscription.UserID)
+	if err != nil {
+		return preferences, err
+	}
+
+	preferences.Email = subscription.Channel == NotificationChannelEmail
+	preferences.SMS = subscription.Channel == NotificationChannelSMS
+	preferences.Webhook = subscription.Channel == NotificationChannelWebhook
+	return preferences, nil
+}
+
+// alertNeighbours warns the opted-in users living around the last seen position of a pet just declared lost
+func alertNeighbours(r *http.Request, pet *Pet) {
+	if pet.Lost.LastSeenLatitude == nil || pet.Lost.LastSeenLongitude == nil {
+		return
+	}
+	latitude, longitude := *pet.Lost.LastSeenLatitude, *pet.Lost.LastSeenLongitude
+
+	// Neighbours are alerted even when no tag can be linked, the alert describing the pet on its own
+	var token, url, photoURL string
+	public := pet.ToPublic()
+	if tag, err := alertPetTag(pet); err == nil {
+		token, url = tag.Token, tag.Url
+		if public.Photo != "" {
+			photoURL = publicPetPhotoURL(tag.Token)
+		}
+	} else if err != gorm.ErrRecordNotFound {
+		LogErr(r, err)
+	}
+
+	// A bounding box of the largest radius narrows the candidates before the exact distance
+	latDelta := float64(maxAlertRadius) / earthRadius * 180 / math.Pi
+	lngDelta := latDelta / math.Max(math.Cos(latitude*math.Pi/180), 0.01)
+	var subscriptions []AlertSubscription
+	db.Where("active = ? AND user_id <> ?", true, pet.UserID).
+		Where("latitude BETWEEN ? AND ?", latitude-latDelta, latitude+latDelta).
+		Where("longitude BETWEEN ? AND ?", longitude-lngDelta, longitude+lngDelta).
+		Where("last_alert_at IS NULL OR last_alert_at < ?", time.Now().Add(-alertThrottle)).
+		Find(&subscriptions)
+
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		distance := haversineMeters(latitude, longitude, subscription.Latitude, subscription.Longitude)
+		if distance > float64(subscription.RadiusMeters) {
+			continue
+		}
+
+		// Claim the slot first so that concurrent alerts don't both go through
+		now := time.Now()
+		result := db.Model(subscription).
+			Where("last_alert_at IS NULL OR last_alert_at < ?", now.Add(-alertThrottle)).
+			Update("last_alert_at", now)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+
+		notification := ReportNotification{
+			Event:   NotificationEventLostAlert,
+			PetName: public.Name,
+			PetSlug: token,
+			Alert: &LostAlertNotification{
+				Pet:               public,
+				LastSeenLocation:  pet.Lost.LastSeenLocation,
+				LastSeenLatitude:  latitude,
+				LastSeenLongitude: longitude,
+				DistanceMeters:    int(distance),
+				URL:               url,
+				PhotoURL:          photoURL,
+				UnsubscribeURL:    alertUnsubscribeURL(subscription.UnsubscribeToken),
+			},
+		}
+		if err := db.First(&notification.Recipient, subscription.UserID).Error; err != nil {
+			LogErr(r, err)
+			continue
+		}
+		preferences, err := alertPreferences(subscription)
+		if err != nil {
+			LogErr(r, err)
+			continue
+		}
+		notification.Preferences = preferences
+
+		sendNotification(r, notification)
+	}
+}
+
+func GetAlertSubscription(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var subscription AlertSubscription
+	if err := db.Where("user_id = ?", userID).First(&subscription).Error; err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "-",
+					Error: "Vous n'êtes pas inscrit aux alertes de votre quartier",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   subscription,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+// UpdateAlertSubscription opts the user in, or moves their home area
+func UpdateAlertSubscription(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var subscriptionRequest AlertSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&subscriptionRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if errors := subscriptionRequest.Validate(); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   subscriptionRequest,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var subscription AlertSubscription
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(AlertSubscription{UserID: userID}).FirstOrInit(&subscription).Error; err != nil {
+			return err
+		}
+
+		if subscription.UnsubscribeToken == "" {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return err
+			}
+			subscription.UnsubscribeToken = hex.EncodeToString(secret)
+		}
+
+		subscription.Latitude = *subscriptionRequest.Latitude
+		subscription.Longitude = *subscriptionRequest.Longitude
+		subscription.RadiusMeters = subscriptionRequest.RadiusMeters
+		subscription.Channel = subscriptionRequest.Channel
+		subscription.Active = true
+		return tx.Save(&subscription).Error
+	})
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   subscription,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func DeleteAlertSubscription(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if err := db.Where("user_id = ?", userID).Delete(&AlertSubscription{}).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   nil,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+// UnsubscribeAlerts is the one-click link of every alert, it needs no login
+// AlertUnsubscribeConfirmation is what the unsubscribe page shows before the user confirms
+type AlertUnsubscribeConfirmation struct {
+	Active  bool   `json:"active"`
+	Message string `json:"message"`
+}
+
+// GetAlertUnsubscribe only describes the subscription behind the link: mail scanners and
+// link previews follow GET links, the change is left to POST
+func GetAlertUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	var subscription AlertSubscription
+	if err := db.Where("unsubscribe_token = ?", mux.Vars(r)["token"]).First(&subscription).Error; err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "token",
+					Error: "Lien de désinscription invalide",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	confirmation := AlertUnsubscribeConfirmation{
+		Active:  subscription.Active,
+		Message: "Confirmez pour ne plus recevoir d'alertes de votre quartier",
+	}
+	if !subscription.Active {
+		confirmation.Message = "Vous ne recevez plus d'alertes de votre quartier"
+	}
+
+	response := HTTPResponse{
+		Data:   confirmation,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+// UnsubscribeAlerts stops the alerts, from the confirmation page or a one-click POST of the mail client (RFC 8058)
+func UnsubscribeAlerts(w http.ResponseWriter, r *http.Request) {
+	result := db.Model(&AlertSubscription{}).
+		Where("unsubscribe_token = ?", mux.Vars(r)["token"]).
+		Update("active", false)
+	if result.Error != nil || result.RowsAffected == 0 {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "token",
+					Error: "Lien de désinscription invalide",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   "Vous ne recevrez plus d'alertes de votre quartier",
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingNotifier keeps the notifications of its channel, wait returning them once delivered
+type recordingNotifier struct {
+	channel string
+	mu      sync.Mutex
+	sent    []ReportNotification
+}
+
+func (n *recordingNotifier) Channel() string {
+	return n.channel
+}
+
+func (n *recordingNotifier) Send(notification ReportNotification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func (n *recordingNotifier) wait(t *testing.T, count int) []ReportNotification {
+	t.Helper()
+
+	var sent []ReportNotification
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		// Delivery is over once it is logged, the database may not be swapped before
+		var logged int64
+		db.Model(&NotificationDelivery{}).Where("status = ?", DeliveryStatusSent).Count(&logged)
+		n.mu.Lock()
+		sent = append([]ReportNotification(nil), n.sent...)
+		n.mu.Unlock()
+		if len(sent) >= count && logged >= int64(count) {
+			return sent
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("%d notifications sent, want %d", len(sent), count)
+	return nil
+}
+
+// lostPetNearby saves a lost pet with a neighbour subscribed to alerts by email
+func lostPetNearby(t *testing.T, tags ...QRCode) *Pet {
+	t.Helper()
+
+	owner := User{Email: "owner@example.com"}
+	neighbour := User{Email: "neighbour@example.com"}
+	db.Create(&owner)
+	db.Create(&neighbour)
+
+	latitude, longitude := 45.7640, 4.8357
+	pet := Pet{
+		Name:    "Rex",
+		Breed:   "Labrador",
+		Sexe:    "male",
+		UserID:  owner.ID,
+		Status:  PetStatusLost,
+		Photo:   "iVBORw0KGgo=",
+		Privacy: PetPrivacy{ShowName: true, ShowPhoto: true},
+		Lost:    LostDetails{LastSeenLatitude: &latitude, LastSeenLongitude: &longitude},
+		// Keeps AfterSave from issuing a tag, the test brings its own
+		QRCodeID: 999,
+	}
+	if err := db.Create(&pet).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i := range tags {
+		tags[i].PetID = pet.ID
+		db.Create(&tags[i])
+	}
+	if len(tags) > 0 {
+		pet.QRCodeID = tags[0].ID
+	}
+
+	db.Create(&AlertSubscription{
+		UserID:           neighbour.ID,
+		Latitude:         45.7700,
+		Longitude:        4.8400,
+		RadiusMeters:     5000,
+		Channel:          NotificationChannelEmail,
+		Active:           true,
+		UnsubscribeToken: "unsubscribe",
+	})
+
+	return &pet
+}
+
+func withRecordingEmail(t *testing.T) *recordingNotifier {
+	notifier := &recordingNotifier{channel: NotificationChannelEmail}
+	previous := reportNotifiers
+	reportNotifiers = []ReportNotifier{notifier}
+	t.Cleanup(func() { reportNotifiers = previous })
+	return notifier
+}
+
+func alertRequest() *http.Request {
+	r := httptest.NewRequest(http.MethodPut, "/pets/rex/lost", nil)
+	return r.WithContext(context.WithValue(r.Context(), "requestID", "test"))
+}
+
+func TestAlertNeighboursFallsBackToActiveTag(t *testing.T) {
+	openTestDB(t, &User{}, &Pet{}, &QRCode{}, &AlertSubscription{}, &NotificationPreference{}, &NotificationDelivery{})
+	t.Setenv("API_URL", "https://api.petcode.example")
+	notifier := withRecordingEmail(t)
+
+	pet := lostPetNearby(t,
+		QRCode{Token: "revoked", Code: "AAAA1111", Url: "https://petcode.example/pet/revoked", Status: TagStatusRevoked},
+		QRCode{Token: "active", Code: "BBBB2222", Url: "https://petcode.example/pet/active", Status: TagStatusActive},
+	)
+	alertNeighbours(alertRequest(), pet)
+
+	alert := notifier.wait(t, 1)[0].Alert
+	if alert.URL != "https://petcode.example/pet/active" {
+		t.Errorf("alert links to %q, want the active tag", alert.URL)
+	}
+	if alert.PhotoURL != "https://api.petcode.example/pet/active/photo" {
+		t.Errorf("unexpected photo link %q", alert.PhotoURL)
+	}
+
+	message := reportMessage(ReportNotification{Alert: alert}, false)
+	if !strings.Contains(message, "Sa photo : https://api.petcode.example/pet/active/photo") {
+		t.Errorf("the email lacks the photo link:\n%s", message)
+	}
+}
+
+func TestAlertNeighboursWithoutTag(t *testing.T) {
+	openTestDB(t, &User{}, &Pet{}, &QRCode{}, &AlertSubscription{}, &NotificationPreference{}, &NotificationDelivery{})
+	notifier := withRecordingEmail(t)
+
+	pet := lostPetNearby(t)
+	alertNeighbours(alertRequest(), pet)
+
+	notification := notifier.wait(t, 1)[0]
+	if notification.Alert.URL != "" || notification.Alert.PhotoURL != "" {
+		t.Errorf("no tag, no link expected, got %+v", notification.Alert)
+	}
+	if message := reportMessage(notification, false); strings.Contains(message, "Voir :") {
+		t.Errorf("the email links to nothing:\n%s", message)
+	}
+}
+
+func TestUnsubscribeAlertsOnlyOnPost(t *testing.T) {
+	openTestDB(t, &AlertSubscription{})
+	db.Create(&AlertSubscription{UserID: 1, Channel: NotificationChannelEmail, Active: true, UnsubscribeToken: "token"})
+
+	router := mux.NewRouter()
+	router.HandleFunc("/alerts/unsubscribe/{token}", GetAlertUnsubscribe).Methods("GET")
+	router.HandleFunc("/alerts/unsubscribe/{token}", UnsubscribeAlerts).Methods("POST")
+	active := func() bool {
+		var subscription AlertSubscription
+		db.First(&subscription)
+		return subscription.Active
+	}
+
+	// Mail scanners follow links, a GET must not unsubscribe
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/alerts/unsubscribe/token", nil))
+	if w.Code != http.StatusOK || !active() {
+		t.Fatalf("GET answered %d and left the subscription active=%v", w.Code, active())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/alerts/unsubscribe/token", strings.NewReader("List-Unsubscribe=One-Click")))
+	if w.Code != http.StatusOK || active() {
+		t.Fatalf("POST answered %d and left the subscription active=%v", w.Code, active())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/alerts/unsubscribe/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown token answered %d, want 404", w.Code)
+	}
+}
+
+func TestAlertEmailOffersOneClickUnsubscribe(t *testing.T) {
+	sink := newSMTPSink(t)
+	notifier := &emailNotifier{Host: "127.0.0.1", Port: sink.port(), From: "petcode@example.com"}
+
+	notification := testNotification()
+	notification.Event = NotificationEventLostAlert
+	notification.Alert = &LostAlertNotification{URL: "https://petcode.example/pet/token", UnsubscribeURL: "https://petcode.example/alerts/unsubscribe/token"}
+	if err := notifier.Send(notification); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	for _, want := range []string{
+		"List-Unsubscribe: <https://petcode.example/alerts/unsubscribe/token>\r\n",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+	} {
+		if len(sink.mails) != 1 || !strings.Contains(sink.mails[0], want) {
+			t.Errorf("mail lacks %q", want)
+		}
+	}
+}
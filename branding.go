@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	defaultQRCaption = "Scannez-moi si je suis perdu"
+	maxQRCaption     = 40
+	// The logo never covers more than this share of the QR code width,
+	// which keeps the hidden modules well under the 30% recovered by level H
+	maxLogoRatio = 0.22
+)
+
+const (
+	QRLogoNone    = "none"
+	QRLogoPetcode = "petcode"
+	QRLogoPhoto   = "photo"
+)
+
+// QRBranding is what gets drawn on top of a plain QR code
+type QRBranding struct {
+	Logo    image.Image
+	Caption string
+}
+
+var (
+	captionFont     *opentype.Font
+	captionFontOnce sync.Once
+	captionFontErr  error
+)
+
+func loadCaptionFont() (*opentype.Font, error) {
+	captionFontOnce.Do(func() {
+		captionFont, captionFontErr = opentype.Parse(gobold.TTF)
+	})
+
+	return captionFont, captionFontErr
+}
+
+// petcodeLogo returns the logo from QR_LOGO_PATH, or draws the Petcode paw
+func petcodeLogo(fg, bg color.RGBA) image.Image {
+	if path := os.Getenv("QR_LOGO_PATH"); path != "" {
+		if file, err := os.Open(path); err == nil {
+			defer file.Close()
+			if logo, _, err := image.Decode(file); err == nil {
+				return logo
+			}
+		}
+	}
+
+	const size = 256
+	logo := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(logo, logo.Bounds(), &image.Uniform{C: bg}, image.Point{}, draw.Src)
+
+	// A paw: one large pad and four toes
+	disc := func(cx, cy, rx, ry float64) {
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				dx, dy := (float64(x)-cx)/rx, (float64(y)-cy)/ry
+				if dx*dx+dy*dy <= 1 {
+					logo.SetRGBA(x, y, fg)
+				}
+			}
+		}
+	}
+	disc(128, 170, 62, 50)
+	disc(58, 104, 24, 30)
+	disc(100, 62, 24, 32)
+	disc(156, 62, 24, 32)
+	disc(198, 104, 24, 30)
+
+	return logo
+}
+
+// renderBrandedQRCode forces the highest error correction, overlays the logo
+// in the middle of the code and writes the caption in a band below it
+func renderBrandedQRCode(content string, options QROptions, branding QRBranding) (image.Image, error) {
+	options.Level = qrcode.Highest
+	code, err := renderQRCodeImage(content, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if branding.Logo != nil {
+		matrix, err := qrMatrix(content, options)
+		if err != nil {
+			return nil, err
+		}
+
+		scale := options.Size / len(matrix)
+		moduleCount := len(matrix) - 2*options.Margin
+		logoSize := int(math.Floor(float64(moduleCount)*maxLogoRatio)) * scale
+		padding := scale
+
+		center := options.Size / 2
+		backdrop := image.Rect(center-logoSize/2-padding, center-logoSize/2-padding, center+logoSize/2+padding, center+logoSize/2+padding)
+		draw.Draw(code, backdrop, &image.Uniform{C: options.Background}, image.Point{}, draw.Src)
+
+		// Keep the logo ratio inside its square
+		bounds := branding.Logo.Bounds()
+		width, height := logoSize, logoSize
+		if bounds.Dx() > bounds.Dy() {
+			height = logoSize * bounds.Dy() / bounds.Dx()
+		} else {
+			width = logoSize * bounds.Dx() / bounds.Dy()
+		}
+		target := image.Rect(center-width/2, center-height/2, center-width/2+width, center-height/2+height)
+		draw.CatmullRom.Scale(code, target, branding.Logo, bounds, draw.Over, nil)
+	}
+
+	if branding.Caption == "" {
+		return code, nil
+	}
+
+	ttf, err := loadCaptionFont()
+	if err != nil {
+		return nil, err
+	}
+
+	// Shrink the font until the caption fits the width
+	band := options.Size / 6
+	fontSize := float64(band) * 0.55
+	var face font.Face
+	for {
+		face, err = opentype.NewFace(ttf, &opentype.FaceOptions{Size: fontSize, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, err
+		}
+		if font.MeasureString(face, branding.Caption).Ceil() <= options.Size*9/10 || fontSize <= 6 {
+			break
+		}
+		face.Close()
+		fontSize *= 0.9
+	}
+	defer face.Close()
+
+	branded := image.NewRGBA(image.Rect(0, 0, options.Size, options.Size+band))
+	draw.Draw(branded, branded.Bounds(), &image.Uniform{C: options.Background}, image.Point{}, draw.Src)
+	draw.Draw(branded, code.Bounds(), code, image.Point{}, draw.Src)
+
+	drawer := font.Drawer{
+		Dst:  branded,
+		Src:  &image.Uniform{C: options.Foreground},
+		Face: face,
+	}
+	metrics := face.Metrics()
+	textWidth := drawer.MeasureString(branding.Caption)
+	drawer.Dot = fixed.Point26_6{
+		X: (fixed.I(options.Size) - textWidth) / 2,
+		Y: fixed.I(options.Size) + (fixed.I(band)+metrics.Ascent-metrics.Descent)/2,
+	}
+	drawer.DrawString(branding.Caption)
+
+	return branded, nil
+}
+
+func GetPetBrandedQRCode(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	query := r.URL.Query()
+	options, errors := parseQROptions(query)
+
+	branding := QRBranding{Caption: defaultQRCaption}
+	if _, ok := query["caption"]; ok {
+		branding.Caption = query.Get("caption")
+	}
+	if utf8.RuneCountInString(branding.Caption) > maxQRCaption {
+		errors = append(errors, FieldError{
+			Field: "caption",
+			Error: fmt.Sprintf("La légende ne doit pas dépasser %d caractères", maxQRCaption),
+		})
+	}
+
+	switch query.Get("logo") {
+	case "", QRLogoPetcode:
+		branding.Logo = petcodeLogo(options.Foreground, options.Background)
+	case QRLogoPhoto:
+		branding.Logo = decodeImage(pet.Photo)
+		if branding.Logo == nil {
+			errors = append(errors, FieldError{
+				Field: "logo",
+				Error: "Votre animal n'a pas de photo",
+			})
+		}
+	case QRLogoNone:
+	default:
+		errors = append(errors, FieldError{
+			Field: "logo",
+			Error: "Le logo doit être petcode, photo ou none",
+		})
+	}
+
+	if len(errors) > 0 {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	img, err := renderBrandedQRCode(pet.QRCode.Url, options, branding)
+	var out bytes.Buffer
+	if err == nil {
+		err = png.Encode(&out, img)
+	}
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if _, err := w.Write(out.Bytes()); err != nil {
+		LogErr(r, err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/makiuchi-d/gozxing"
+	gozxingqr "github.com/makiuchi-d/gozxing/qrcode"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func decodeQRCode(t *testing.T, img image.Image) string {
+	t.Helper()
+
+	bitmap, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gozxingqr.NewQRCodeReader().Decode(bitmap, nil)
+	if err != nil {
+		t.Fatalf("branded QR code doesn't decode: %v", err)
+	}
+
+	return result.GetText()
+}
+
+func TestBrandedQRCodeStillDecodes(t *testing.T) {
+	const content = "https://petcode.example/pet/7b0c1c9e-2f4e-4d8a-9a51-0d6f4e1b3c2a"
+
+	tests := []struct {
+		name     string
+		options  func() QROptions
+		branding func(options QROptions) QRBranding
+	}{
+		{
+			name:    "logo and caption",
+			options: defaultQROptions,
+			branding: func(options QROptions) QRBranding {
+				return QRBranding{Logo: petcodeLogo(options.Foreground, options.Background), Caption: defaultQRCaption}
+			},
+		},
+		{
+			name: "coloured and large",
+			options: func() QROptions {
+				options := defaultQROptions()
+				options.Size = 512
+				options.Foreground = color.RGBA{R: 0x1a, G: 0x3c, B: 0x8f, A: 0xff}
+				return options
+			},
+			branding: func(options QROptions) QRBranding {
+				return QRBranding{Logo: petcodeLogo(options.Foreground, options.Background), Caption: "Rex"}
+			},
+		},
+		{
+			name:    "caption only",
+			options: defaultQROptions,
+			branding: func(options QROptions) QRBranding {
+				return QRBranding{Caption: defaultQRCaption}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := test.options()
+			img, err := renderBrandedQRCode(content, options, test.branding(options))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := decodeQRCode(t, img); got != content {
+				t.Errorf("decoded %q, want %q", got, content)
+			}
+		})
+	}
+}
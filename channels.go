@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	NotificationChannelEmail   = "email"
+	NotificationChannelSMS     = "sms"
+	NotificationChannelWebhook = "webhook"
+)
+
+// ReportNotifier delivers report notifications through one channel
+type ReportNotifier interface {
+	Channel() string
+	Send(notification ReportNotification) error
+}
+
+// SMSProvider is implemented by each SMS gateway
+type SMSProvider interface {
+	SendSMS(to string, body string) error
+}
+
+// reportNotifiers are the channels configured at startup
+var reportNotifiers []ReportNotifier
+
+var notificationClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookClient only dials public addresses, the check happening on the resolved address so that
+// a DNS answer changed after validation can't point a webhook at the internal network
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return fmt.Errorf("Webhook address %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// Shared address space of carrier-grade NATs, private in practice
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP rejects loopback, private, link-local and other addresses webhooks must not reach
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// checkWebhookHost resolves the host of a webhook and refuses it when any of its addresses isn't public
+func checkWebhookHost(host string) error {
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("L'hôte du webhook est introuvable")
+	}
+
+	for _, ip := range ips {
+		if !isPublicIP(ip.IP) {
+			return fmt.Errorf("Le webhook doit pointer vers une adresse publique")
+		}
+	}
+	return nil
+}
+
+// loadReportNotifiers enables email and SMS when their servers are configured, webhooks always
+func loadReportNotifiers() []ReportNotifier {
+	var notifiers []ReportNotifier
+
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+		if err != nil {
+			port = 587
+		}
+		notifiers = append(notifiers, &emailNotifier{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		})
+	}
+
+	if url := os.Getenv("SMS_API_URL"); url != "" {
+		notifiers = append(notifiers, &smsNotifier{
+			Provider: &httpSMSProvider{
+				URL:    url,
+				APIKey: os.Getenv("SMS_API_KEY"),
+				Sender: os.Getenv("SMS_SENDER"),
+			},
+		})
+	}
+
+	return append(notifiers, &webhookNotifier{})
+}
+
+// reportMessage is the plain text shared by emails and SMS
+func reportMessage(notification ReportNotification, short bool) string {
+	report := notification.Report
+
+	var b strings.Builder
+	if message := notification.Message; message != nil {
+		fmt.Fprintf(&b, "Nouveau message au sujet de %s : %s", notification.PetName, message.Body)
+		fmt.Fprintf(&b, "\n\nRépondre : %s", message.ReplyURL)
+		return b.String()
+	}
+
+	if alert := notification.Alert; alert != nil {
+		name := alert.Pet.Name
+		if name == "" {
+			name = "Un animal"
+		}
+		fmt.Fprintf(&b, "%s %s a été perdu(e) à %d m de chez vous", name, alert.Pet.Breed, alert.DistanceMeters)
+		if alert.LastSeenLocation != "" {
+			fmt.Fprintf(&b, ", vu(e) pour la dernière fois : %s", alert.LastSeenLocation)
+		}
+		b.WriteString(".")
+		if alert.URL != "" {
+			fmt.Fprintf(&b, " Voir : %s", alert.URL)
+		}
+		if short {
+			return strings.Join(strings.Fields(b.String()), " ")
+		}
+		if alert.PhotoURL != "" {
+			fmt.Fprintf(&b, "\n\nSa photo : %s", alert.PhotoURL)
+		}
+		fmt.Fprintf(&b, "\n\nNe plus recevoir ces alertes : %s", alert.UnsubscribeURL)
+		return b.String()
+	}
+
+	if match := notification.Match; match != nil {
+		fmt.Fprintf(&b, "Un animal trouvé ressemble à %s : %s %s %s", notification.PetName, match.Species, match.Breed, match.Colour)
+		if match.Where != "" || match.City != "" {
+			fmt.Fprintf(&b, ", %s %s", match.Where, match.City)
+		}
+		fmt.Fprintf(&b, ". Voir : %s", match.URL)
+		return strings.Join(strings.Fields(b.String()), " ")
+	}
+
+	if report.HasPet {
+		fmt.Fprintf(&b, "%s a été retrouvé !", notification.PetName)
+	} else {
+		fmt.Fprintf(&b, "%s a été aperçu.", notification.PetName)
+	}
+	if report.Where != "" || report.City != "" {
+		fmt.Fprintf(&b, " Lieu : %s %s.", report.Where, report.City)
+	}
+	if report.PhoneNumber != "" {
+		fmt.Fprintf(&b, " Contact : %s.", report.PhoneNumber)
+	}
+	if short {
+		return strings.TrimSpace(b.String())
+	}
+
+	if report.Additional != "" {
+		fmt.Fprintf(&b, "\n\nMessage : %s", report.Additional)
+	}
+	if len(notification.MedicalAlerts) > 0 {
+		b.WriteString("\n\nAlertes médicales à transmettre :")
+		for _, alert := range notification.MedicalAlerts {
+			fmt.Fprintf(&b, "\n- %s", alert.Label)
+			if alert.Details != "" {
+				fmt.Fprintf(&b, " : %s", alert.Details)
+			}
+		}
+	}
+	fmt.Fprintf(&b, "\n\nRetrouvez le signalement sur %s", os.Getenv("FRONTEND_URL"))
+
+	return b.String()
+}
+
+type emailNotifier struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (n *emailNotifier) Channel() string {
+	return NotificationChannelEmail
+}
+
+func (n *emailNotifier) Send(notification ReportNotification) error {
+	// Finders' addresses end up here through the relay, never write them raw in a header
+	recipient, err := mail.ParseAddress(notification.Recipient.Email)
+	if err != nil || strings.ContainsAny(notification.Recipient.Email, "\r\n") {
+		return fmt.Errorf("Invalid recipient address %q", notification.Recipient.Email)
+	}
+
+	subject := fmt.Sprintf("Nouveau signalement pour %s", notification.PetName)
+	switch {
+	case notification.Message != nil:
+		subject = fmt.Sprintf("Nouveau message au sujet de %s", notification.PetName)
+	case notification.Match != nil:
+		subject = fmt.Sprintf("Un animal trouvé ressemble à %s", notification.PetName)
+	case notification.Alert != nil:
+		subject = "Un animal est perdu près de chez vous"
+	}
+	subject = mime.QEncoding.Encode("utf-8", subject)
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.From)
+	fmt.Fprintf(&message, "To: %s\r\n", recipient.String())
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	if notification.Alert != nil {
+		fmt.Fprintf(&message, "List-Unsubscribe: <%s>\r\n", notification.Alert.UnsubscribeURL)
+		message.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(reportMessage(notification, false), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+
+	return smtp.SendMail(fmt.Sprintf("%s:%d", n.Host, n.Port), auth, n.From, []string{recipient.Address}, message.Bytes())
+}
+
+type smsNotifier struct {
+	Provider SMSProvider
+}
+
+func (n *smsNotifier) Channel() string {
+	return NotificationChannelSMS
+}
+
+func (n *smsNotifier) Send(notification ReportNotification) error {
+	return n.Provider.SendSMS(notification.Recipient.Phone, reportMessage(notification, true))
+}
+
+// httpSMSProvider posts the message as JSON to a gateway authenticated with a bearer key
+type httpSMSProvider struct {
+	URL    string
+	APIKey string
+	Sender string
+}
+
+func (p *httpSMSProvider) SendSMS(to string, body string) error {
+	payload, err := json.Marshal(map[string]string{"to": to, "from": p.Sender, "text": body})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.APIKey)
+	}
+
+	res, err := notificationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("SMS gateway answered %d", res.StatusCode)
+	}
+	return nil
+}
+
+// webhookNotifier posts the notification to the owner's URL, signed with the owner's secret
+type webhookNotifier struct{}
+
+func (n *webhookNotifier) Channel() string {
+	return NotificationChannelWebhook
+}
+
+// signWebhook is the hex HMAC-SHA256 of "timestamp.body", checked by receivers to trust the payload
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *webhookNotifier) Send(notification ReportNotification) error {
+	body, err := json.Marshal(struct {
+		Event string             `json:"event"`
+		Data  ReportNotification `json:"data"`
+	}{
+		Event: notification.Event,
+		Data:  notification,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, notification.Preferences.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Petcode-Timestamp", timestamp)
+	req.Header.Set("X-Petcode-Signature", "sha256="+signWebhook(notification.Preferences.WebhookSecret, timestamp, body))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Webhook answered %d", res.StatusCode)
+	}
+	return nil
+}
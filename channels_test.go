@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testNotification() ReportNotification {
+	return ReportNotification{
+		Event:     NotificationEventReport,
+		Recipient: User{Email: "owner@example.com", Phone: "+33612345678"},
+		PetName:   "Rex",
+		PetSlug:   "rex",
+		Report: ReportResponse{
+			ID:          42,
+			City:        "Lyon",
+			Where:       "Parc de la Tête d'Or",
+			HasPet:      true,
+			PhoneNumber: "+33698765432",
+		},
+	}
+}
+
+// fakeSMSProvider records the messages instead of calling a gateway
+type fakeSMSProvider struct {
+	mu   sync.Mutex
+	sent []string
+	err  error
+}
+
+func (p *fakeSMSProvider) SendSMS(to string, body string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	p.sent = append(p.sent, to+": "+body)
+	return nil
+}
+
+func TestSMSNotifierSendsShortMessage(t *testing.T) {
+	provider := &fakeSMSProvider{}
+	notifier := &smsNotifier{Provider: provider}
+
+	if err := notifier.Send(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(provider.sent) != 1 {
+		t.Fatalf("sent %d SMS, want 1", len(provider.sent))
+	}
+	sms := provider.sent[0]
+	if !strings.HasPrefix(sms, "+33612345678: Rex a été retrouvé !") {
+		t.Errorf("unexpected SMS %q", sms)
+	}
+	if strings.Contains(sms, "\n") {
+		t.Errorf("SMS should fit on one line, got %q", sms)
+	}
+}
+
+func TestWebhookNotifierSignsPayload(t *testing.T) {
+	const secret = "s3cr3t"
+
+	var received struct {
+		Event string             `json:"event"`
+		Data  ReportNotification `json:"data"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Petcode-Timestamp")
+		if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+			t.Errorf("bad timestamp %q", timestamp)
+		}
+		if got, want := r.Header.Get("X-Petcode-Signature"), "sha256="+signWebhook(secret, timestamp, body); got != want {
+			t.Errorf("signature %q, want %q", got, want)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// The test server listens on loopback, which the real client refuses
+	previous := webhookClient
+	webhookClient = server.Client()
+	defer func() { webhookClient = previous }()
+
+	notification := testNotification()
+	notification.Preferences = NotificationPreference{Webhook: true, WebhookURL: server.URL, WebhookSecret: secret}
+	if err := (&webhookNotifier{}).Send(notification); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Event != NotificationEventReport || received.Data.Report.ID != 42 {
+		t.Errorf("unexpected payload %+v", received)
+	}
+}
+
+func TestWebhookNotifierReportsErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	previous := webhookClient
+	webhookClient = server.Client()
+	defer func() { webhookClient = previous }()
+
+	notification := testNotification()
+	notification.Preferences = NotificationPreference{Webhook: true, WebhookURL: server.URL, WebhookSecret: "secret"}
+	if err := (&webhookNotifier{}).Send(notification); err == nil {
+		t.Fatal("expected an error on a 500 answer")
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the webhook reached a loopback address")
+	}))
+	defer server.Close()
+
+	notification := testNotification()
+	notification.Preferences = NotificationPreference{Webhook: true, WebhookURL: server.URL, WebhookSecret: "secret"}
+	if err := (&webhookNotifier{}).Send(notification); err == nil {
+		t.Fatal("expected the loopback webhook to be refused")
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		if got := isPublicIP(net.ParseIP(test.ip)); got != test.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", test.ip, got, test.public)
+		}
+	}
+}
+
+// smtpSink accepts mails on a local port and keeps what it received
+type smtpSink struct {
+	listener net.Listener
+	mu       sync.Mutex
+	mails    []string
+	rcpts    []string
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &smtpSink{listener: listener}
+	go sink.serve()
+	t.Cleanup(func() { listener.Close() })
+	return sink
+}
+
+func (s *smtpSink) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpSink) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+
+	reply("220 sink ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 sink")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			s.mu.Lock()
+			s.rcpts = append(s.rcpts, strings.TrimSpace(line[len("RCPT TO:"):]))
+			s.mu.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 Go ahead")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			s.mu.Lock()
+			s.mails = append(s.mails, data.String())
+			s.mu.Unlock()
+			reply("250 OK")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *smtpSink) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestEmailNotifierSendsThroughSMTP(t *testing.T) {
+	sink := newSMTPSink(t)
+	notifier := &emailNotifier{Host: "127.0.0.1", Port: sink.port(), From: "petcode@example.com"}
+
+	if err := notifier.Send(testNotification()); err != nil {
+		t.Fatal(err)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.mails) != 1 {
+		t.Fatalf("received %d mails, want 1", len(sink.mails))
+	}
+	mail := sink.mails[0]
+	for _, want := range []string{"To: <owner@example.com>\r\n", "Subject: Nouveau signalement pour Rex\r\n", "Rex a été retrouvé !", "Contact : +33698765432"} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail lacks %q:\n%s", want, mail)
+		}
+	}
+	if len(sink.rcpts) != 1 || sink.rcpts[0] != "<owner@example.com>" {
+		t.Errorf("unexpected recipients %v", sink.rcpts)
+	}
+}
+
+func TestNotificationPreferenceEnabled(t *testing.T) {
+	owner := User{Email: "owner@example.com", Phone: "+33612345678"}
+	tests := []struct {
+		name        string
+		preferences NotificationPreference
+		owner       User
+		channel     string
+		enabled     bool
+	}{
+		{"email wanted", NotificationPreference{Email: true}, owner, NotificationChannelEmail, true},
+		{"email not wanted", NotificationPreference{}, owner, NotificationChannelEmail, false},
+		{"email without address", NotificationPreference{Email: true}, User{Phone: owner.Phone}, NotificationChannelEmail, false},
+		{"sms wanted", NotificationPreference{SMS: true}, owner, NotificationChannelSMS, true},
+		{"sms without phone", NotificationPreference{SMS: true}, User{Email: owner.Email}, NotificationChannelSMS, false},
+		{"webhook wanted", NotificationPreference{Webhook: true, WebhookURL: "https://example.com/hook", WebhookSecret: "secret"}, owner, NotificationChannelWebhook, true},
+		{"webhook without url", NotificationPreference{Webhook: true, WebhookSecret: "secret"}, owner, NotificationChannelWebhook, false},
+		{"webhook without secret", NotificationPreference{Webhook: true, WebhookURL: "https://example.com/hook"}, owner, NotificationChannelWebhook, false},
+		{"unknown channel", NotificationPreference{Email: true, SMS: true}, owner, "pigeon", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.preferences.Enabled(test.channel, test.owner); got != test.enabled {
+				t.Errorf("Enabled(%s) = %v, want %v", test.channel, got, test.enabled)
+			}
+		})
+	}
+}
+
+func TestEmailNotifierRefusesHeaderInjection(t *testing.T) {
+	sink := newSMTPSink(t)
+	notifier := &emailNotifier{Host: "127.0.0.1", Port: sink.port(), From: "petcode@example.com"}
+
+	notification := testNotification()
+	notification.Recipient.Email = "a@b.c\r\nBcc: x@y.z"
+	if err := notifier.Send(notification); err == nil {
+		t.Fatal("expected the address with a line break to be refused")
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.mails) != 0 {
+		t.Errorf("no mail should have been sent, got %d", len(sink.mails))
+	}
+}
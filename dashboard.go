@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Dashboard sums up the owner's pets and the reports about them
+type Dashboard struct {
+	Pets            int64            `json:"pets"`
+	LostPets        int64            `json:"lost_pets"`
+	UnreadReports   int64            `json:"unread_reports"`
+	ReportsByStatus map[string]int64 `json:"reports_by_status"`
+}
+
+func GetDashboard(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	dashboard := Dashboard{ReportsByStatus: make(map[string]int64)}
+	for status := range reportTransitions {
+		dashboard.ReportsByStatus[status] = 0
+	}
+
+	db.Model(&Pet{}).Where("user_id = ?", userID).Count(&dashboard.Pets)
+	db.Model(&Pet{}).Where("user_id = ?", userID).Where("status = ?", PetStatusLost).Count(&dashboard.LostPets)
+	userReports(userID).Where("reports.archived_at IS NULL").Where("reports.read_at IS NULL").Count(&dashboard.UnreadReports)
+
+	var counts []struct {
+		Status string
+		Count  int64
+	}
+	if err := userReports(userID).Select("reports.status, count(*) as count").Group("reports.status").Scan(&counts).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+	for _, count := range counts {
+		dashboard.ReportsByStatus[count.Status] = count.Count
+	}
+
+	response := HTTPResponse{
+		Data:   dashboard,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
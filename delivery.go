@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSent    = "sent"
+	DeliveryStatusFailed  = "failed"
+)
+
+const maxDeliveryAttempts = 5
+
+// Attempts wait 10s, 20s, 40s then 80s, so the owner still hears within minutes
+var deliveryBackoff = 10 * time.Second
+
+// NotificationDelivery logs the sending of a report notification through one channel
+type NotificationDelivery struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	ReportID    uint       `gorm:"index" json:"report_id"`
+	Event       string     `gorm:"type:varchar(20);default:'report.created'" json:"event"`
+	Channel     string     `gorm:"type:varchar(10)" json:"channel"`
+	Status      string     `gorm:"type:varchar(10)" json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `gorm:"type:varchar(255)" json:"last_error"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+}
+
+// deliver sends the notification, retrying with an exponential backoff, and logs every attempt
+func deliver(notifier ReportNotifier, notification ReportNotification, delivery NotificationDelivery) {
+	for delivery.Attempts < maxDeliveryAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(deliveryBackoff << (delivery.Attempts - 1))
+		}
+
+		delivery.Attempts++
+		err := notifier.Send(notification)
+		if err == nil {
+			now := time.Now()
+			delivery.Status = DeliveryStatusSent
+			delivery.DeliveredAt = &now
+			delivery.LastError = ""
+		} else {
+			delivery.LastError = err.Error()
+			if len(delivery.LastError) > 255 {
+				delivery.LastError = delivery.LastError[:255]
+			}
+			if delivery.Attempts >= maxDeliveryAttempts {
+				delivery.Status = DeliveryStatusFailed
+			}
+		}
+
+		if err := db.Save(&delivery).Error; err != nil {
+			log.Error().Msg(err.Error())
+		}
+		if delivery.Status != DeliveryStatusPending {
+			log.Info().Uint("Report", delivery.ReportID).Str("Channel", delivery.Channel).
+				Str("Status", delivery.Status).Int("Attempts", delivery.Attempts).Msg("Report notification delivery")
+			return
+		}
+	}
+}
+
+// resumeDeliveries restarts the report deliveries interrupted by a shutdown,
+// relay messages are not worth sending late since they are read in the conversation
+func resumeDeliveries() {
+	var deliveries []NotificationDelivery
+	if err := db.Where("status = ?", DeliveryStatusPending).Where("event = ?", NotificationEventReport).Find(&deliveries).Error; err != nil {
+		log.Error().Msg(err.Error())
+		return
+	}
+
+	for _, delivery := range deliveries {
+		var report Report
+		var pet Pet
+		if err := db.Preload("Photos").First(&report, delivery.ReportID).Error; err != nil {
+			log.Error().Msg(err.Error())
+			continue
+		}
+		if err := db.First(&pet, report.PetID).Error; err != nil {
+			log.Error().Msg(err.Error())
+			continue
+		}
+
+		notification, err := newReportNotification(&pet, &report)
+		if err != nil {
+			log.Error().Msg(err.Error())
+			continue
+		}
+
+		for _, notifier := range reportNotifiers {
+			if notifier.Channel() == delivery.Channel {
+				go deliver(notifier, notification, delivery)
+			}
+		}
+	}
+}
+
+func GetReportDeliveries(w http.ResponseWriter, r *http.Request) {
+	report, status, errors := userReport(r)
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var deliveries []NotificationDelivery
+	db.Where("report_id = ?", report.ID).Order("created_at").Find(&deliveries)
+
+	response := HTTPResponse{
+		Data:   deliveries,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
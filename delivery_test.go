@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyNotifier fails a given number of times before succeeding, and records when it was called
+type flakyNotifier struct {
+	mu       sync.Mutex
+	failures int
+	calls    []time.Time
+}
+
+func (n *flakyNotifier) Channel() string {
+	return NotificationChannelSMS
+}
+
+func (n *flakyNotifier) Send(notification ReportNotification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.calls = append(n.calls, time.Now())
+	if len(n.calls) <= n.failures {
+		return fmt.Errorf("gateway down (%d) %s", len(n.calls), strings.Repeat("x", 300))
+	}
+	return nil
+}
+
+func withDeliveryBackoff(t *testing.T, backoff time.Duration) {
+	previous := deliveryBackoff
+	deliveryBackoff = backoff
+	t.Cleanup(func() { deliveryBackoff = previous })
+}
+
+func newTestDelivery(t *testing.T) NotificationDelivery {
+	delivery := NotificationDelivery{
+		ReportID: 42,
+		Event:    NotificationEventReport,
+		Channel:  NotificationChannelSMS,
+		Status:   DeliveryStatusPending,
+	}
+	if err := db.Create(&delivery).Error; err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func TestDeliverRetriesWithBackoff(t *testing.T) {
+	openTestDB(t, &NotificationDelivery{})
+	withDeliveryBackoff(t, 5*time.Millisecond)
+
+	notifier := &flakyNotifier{failures: 2}
+	delivery := newTestDelivery(t)
+	deliver(notifier, testNotification(), delivery)
+
+	if len(notifier.calls) != 3 {
+		t.Fatalf("%d attempts, want 3", len(notifier.calls))
+	}
+	for i := 1; i < len(notifier.calls); i++ {
+		wait := notifier.calls[i].Sub(notifier.calls[i-1])
+		if least := deliveryBackoff << (i - 1); wait < least {
+			t.Errorf("attempt %d waited %s, want at least %s", i+1, wait, least)
+		}
+	}
+
+	var logged NotificationDelivery
+	if err := db.First(&logged, delivery.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if logged.Status != DeliveryStatusSent || logged.Attempts != 3 {
+		t.Errorf("logged %s after %d attempts, want sent after 3", logged.Status, logged.Attempts)
+	}
+	if logged.DeliveredAt == nil || logged.LastError != "" {
+		t.Errorf("a sent delivery must have a date and no error, got %+v", logged)
+	}
+}
+
+func TestDeliverGivesUpAfterMaxAttempts(t *testing.T) {
+	openTestDB(t, &NotificationDelivery{})
+	withDeliveryBackoff(t, time.Millisecond)
+
+	notifier := &flakyNotifier{failures: maxDeliveryAttempts + 1}
+	delivery := newTestDelivery(t)
+	deliver(notifier, testNotification(), delivery)
+
+	if len(notifier.calls) != maxDeliveryAttempts {
+		t.Fatalf("%d attempts, want %d", len(notifier.calls), maxDeliveryAttempts)
+	}
+
+	var logged NotificationDelivery
+	if err := db.First(&logged, delivery.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if logged.Status != DeliveryStatusFailed || logged.Attempts != maxDeliveryAttempts {
+		t.Errorf("logged %s after %d attempts, want failed after %d", logged.Status, logged.Attempts, maxDeliveryAttempts)
+	}
+	if logged.DeliveredAt != nil {
+		t.Error("a failed delivery must not have a delivery date")
+	}
+	if !strings.HasPrefix(logged.LastError, "gateway down (5)") || len(logged.LastError) != 255 {
+		t.Errorf("last error should be the truncated last failure, got %d bytes %.40q", len(logged.LastError), logged.LastError)
+	}
+}
+
+func TestSendNotificationLogsEnabledChannels(t *testing.T) {
+	openTestDB(t, &NotificationDelivery{})
+	withDeliveryBackoff(t, time.Millisecond)
+
+	sms := &fakeSMSProvider{}
+	previous := reportNotifiers
+	reportNotifiers = []ReportNotifier{&smsNotifier{Provider: sms}, &webhookNotifier{}}
+	defer func() { reportNotifiers = previous }()
+
+	notification := testNotification()
+	notification.Preferences = NotificationPreference{SMS: true}
+	sendNotification(nil, notification)
+
+	// Delivery runs in the background
+	deadline := time.Now().Add(2 * time.Second)
+	var deliveries []NotificationDelivery
+	for time.Now().Before(deadline) {
+		db.Find(&deliveries)
+		if len(deliveries) == 1 && deliveries[0].Status == DeliveryStatusSent {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(deliveries) != 1 {
+		t.Fatalf("logged %d deliveries, want only the enabled SMS channel", len(deliveries))
+	}
+	if deliveries[0].Channel != NotificationChannelSMS || deliveries[0].Status != DeliveryStatusSent || deliveries[0].ReportID != 42 {
+		t.Errorf("unexpected delivery %+v", deliveries[0])
+	}
+	sms.mu.Lock()
+	defer sms.mu.Unlock()
+	if len(sms.sent) != 1 {
+		t.Errorf("sent %d SMS, want 1", len(sms.sent))
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+const maxEmailLength = 50
+
+// normalizeEmail keeps the bare address of an email given by a visitor, refusing anything
+// that could add a header once written in a mail, like line breaks
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if strings.ContainsAny(email, "\r\n\x00") {
+		return "", fmt.Errorf("L'adresse email n'est pas valide")
+	}
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" || len(address.Address) > maxEmailLength {
+		return "", fmt.Errorf("L'adresse email n'est pas valide")
+	}
+
+	return address.Address, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+		valid bool
+	}{
+		{"finder@example.com", "finder@example.com", true},
+		{"  finder@example.com ", "finder@example.com", true},
+		{"a@b.c\r\nBcc: x@y.z", "", false},
+		{"a@b.c\nBcc: x@y.z", "", false},
+		{"Finder <finder@example.com>", "", false},
+		{"finder@example.com, other@example.com", "", false},
+		{"not an email", "", false},
+		{"@example.com", "", false},
+		{"very.long.address.for.a.finder@a-rather-long-domain.example.com", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := normalizeEmail(test.email)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("normalizeEmail(%q) = %q, %v, want %q (valid %v)", test.email, got, err, test.want, test.valid)
+		}
+	}
+}
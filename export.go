@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func ExportPets(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "csv" && format != "json" {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "format",
+					Error: "Le format doit être csv ou json",
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var pets []Pet
+	if err := db.Preload("QRCode").Preload("MedicalAlerts").Where("user_id = ?", userID).Order("id").Find(&pets).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusInternalServerError,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	filename := fmt.Sprintf("petcode-%s.%s", time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(pets); err != nil {
+			LogErr(r, err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"slug", "name", "breed", "sexe", "birthdate", "status", "medical_alerts", "qrcode_url"})
+	for _, pet := range pets {
+		var alerts []string
+		for _, alert := range pet.MedicalAlerts {
+			alerts = append(alerts, alert.Label)
+		}
+
+		_ = writer.Write([]string{
+			pet.Slug,
+			pet.Name,
+			pet.Breed,
+			pet.Sexe,
+			pet.Birthdate,
+			pet.Status,
+			strings.Join(alerts, "; "),
+			pet.QRCode.Url,
+		})
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		LogErr(r, err)
+	}
+}
+
+// decodeImage reads a base64 PNG or JPEG, returning nil when it can't
+func decodeImage(encoded string) image.Image {
+	if encoded == "" {
+		return nil
+	}
+
+	raw, err := decodeBase64Image(encoded)
+	if err != nil {
+		return nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+
+	return img
+}
+
+// GetPetSheet renders the one-page identity sheet of a pet
+func GetPetSheet(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	doc := newPDFDocument(pdfA4Width, pdfA4Height)
+	page := doc.AddPage()
+	margin := 50.0
+
+	page.Text(margin, margin, 26, true, pet.Name)
+	page.Text(margin, margin+32, 11, false, "Fiche d'identité Petcode")
+	page.Line(margin, margin+52, pdfA4Width-margin, margin+52, 1)
+
+	// Photo on the left, QR code on the right
+	top := margin + 70
+	if photo := decodeImage(pet.Photo); photo != nil {
+		// Fit the photo in a 180x180 box keeping its ratio
+		bounds := photo.Bounds()
+		width, height := 180.0, 180.0
+		if bounds.Dx() > bounds.Dy() {
+			height = width * float64(bounds.Dy()) / float64(bounds.Dx())
+		} else {
+			width = height * float64(bounds.Dx()) / float64(bounds.Dy())
+		}
+		page.Image(photo, margin, top, width, height)
+	}
+
+	if qr, err := renderQRCodeImage(pet.QRCode.Url, defaultQROptions()); err == nil {
+		size := 160.0
+		page.Image(qr, pdfA4Width-margin-size, top, size, size)
+		page.TextCentered(pdfA4Width-margin-size/2, top+size+4, 8, false, pet.QRCode.Url)
+		if pet.QRCode.Code != "" {
+			page.TextCentered(pdfA4Width-margin-size/2, top+size+16, 11, true, formatTagCode(pet.QRCode.Code))
+		}
+	}
+
+	y := top + 260
+	section := func(title string) {
+		page.Text(margin, y, 14, true, title)
+		page.Line(margin, y+18, pdfA4Width-margin, y+18, 0.5)
+		y += 28
+	}
+	row := func(label, value string) {
+		page.Text(margin, y, 11, true, label)
+		page.Text(margin+130, y, 11, false, value)
+		y += 18
+	}
+
+	section("Identification")
+	row("Race", pet.Breed)
+	row("Sexe", pet.Sexe)
+	row("Date de naissance", pet.Birthdate)
+	row("Identifiant", pet.Slug)
+	y += 10
+
+	section("Alertes médicales")
+	if len(pet.MedicalAlerts) == 0 {
+		row("-", "Aucune alerte")
+	}
+	for _, alert := range pet.MedicalAlerts {
+		row(alert.Kind, strings.TrimSpace(alert.Label+" "+alert.Details))
+	}
+	y += 10
+
+	section("Propriétaire")
+	row("Nom", strings.TrimSpace(pet.User.Firstname+" "+pet.User.Name))
+	row("Email", pet.User.Email)
+	if pet.User.Phone != "" {
+		row("Téléphone", pet.User.Phone)
+	}
+
+	var out bytes.Buffer
+	if _, err := doc.WriteTo(&out); err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusInternalServerError,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", pet.Slug+".pdf"))
+	if _, err := w.Write(out.Bytes()); err != nil {
+		LogErr(r, err)
+	}
+}
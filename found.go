@@ -0,0 +1,648 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	FoundSexUnknown = "unknown"
+)
+
+const (
+	MatchStatusProposed  = "proposed"
+	MatchStatusConfirmed = "confirmed"
+	MatchStatusDismissed = "dismissed"
+)
+
+const (
+	// Found animals are compared with pets lost during this window
+	matchWindow = 60 * 24 * time.Hour
+	// Below this score a lost pet is not proposed to its owner
+	minMatchScore = 40
+)
+
+// FoundReport describes an animal picked up by a finder, without any Petcode tag to scan
+type FoundReport struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Species     string    `gorm:"type:varchar(20)" json:"species"`
+	Breed       string    `gorm:"type:varchar(50)" json:"breed"`
+	Sexe        string    `gorm:"type:varchar(10)" json:"sexe"`
+	Colour      string    `gorm:"type:varchar(50)" json:"colour"`
+	City        string    `gorm:"type:varchar(50)" json:"city"`
+	Where       string    `gorm:"type:varchar(100)" json:"where"`
+	Latitude    *float64  `json:"latitude"`
+	Longitude   *float64  `json:"longitude"`
+	FoundAt     time.Time `json:"found_at"`
+	PhoneNumber string    `gorm:"type:varchar(20)" json:"phone_number"`
+	Email       string    `gorm:"type:varchar(50)" json:"email"`
+	Additional  string    `gorm:"type:varchar(255)" json:"additional"`
+
+	// Photos go through the storage, PhotoLinks signs temporary links to them
+	Photos     []ReportPhoto         `gorm:"foreignKey:FoundReportID" json:"-"`
+	PhotoLinks []ReportPhotoResponse `gorm:"-" json:"photos"`
+
+	// Website is a honeypot hidden to humans, Proof answers the challenge of GET /found/challenge
+	Website     string    `gorm:"-" json:"website,omitempty"`
+	Nonce       string    `gorm:"-" json:"nonce,omitempty"`
+	Proof       string    `gorm:"-" json:"proof,omitempty"`
+	Fingerprint string    `gorm:"type:varchar(64);index" json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// FoundMatch proposes a found animal to the owner of a lost pet
+type FoundMatch struct {
+	ID            uint        `gorm:"primaryKey" json:"id"`
+	FoundReportID uint        `gorm:"uniqueIndex:idx_found_match" json:"found_report_id"`
+	FoundReport   FoundReport `json:"found_report"`
+	PetID         uint        `gorm:"uniqueIndex:idx_found_match;index" json:"pet_id"`
+	Score         int         `json:"score"`
+	Status        string      `gorm:"type:varchar(10);default:'proposed'" json:"status"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+type FoundMatchRequest struct {
+	Status string `json:"status"`
+}
+
+// MatchNotification tells an owner that a found animal looks like their lost pet
+type MatchNotification struct {
+	Score   int    `json:"score"`
+	Species string `json:"species"`
+	Breed   string `json:"breed"`
+	Colour  string `json:"colour"`
+	City    string `json:"city"`
+	Where   string `json:"where"`
+	URL     string `json:"url"`
+}
+
+// Validate also trims the report and normalizes the phone number to E.164
+func (f *FoundReport) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	f.Species = strings.ToLower(strings.TrimSpace(f.Species))
+	f.Breed = strings.TrimSpace(f.Breed)
+	f.Colour = strings.TrimSpace(f.Colour)
+	f.City = strings.TrimSpace(f.City)
+	f.Where = strings.TrimSpace(f.Where)
+	f.Email = strings.TrimSpace(f.Email)
+	f.Additional = strings.TrimSpace(f.Additional)
+
+	// Species is required
+	if f.Species == "" || utf8.RuneCountInString(f.Species) > 20 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "species",
+			Error: "L'espèce est obligatoire",
+		})
+	}
+
+	if f.Sexe == "" {
+		f.Sexe = FoundSexUnknown
+	}
+	if f.Sexe != "male" && f.Sexe != "female" && f.Sexe != FoundSexUnknown {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "sexe",
+			Error: "Est-ce un male, une femelle, ou ne savez-vous pas ?",
+		})
+	}
+
+	if utf8.RuneCountInString(f.Breed) > 50 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "breed",
+			Error: "La race ne doit pas dépasser 50 caractères",
+		})
+	}
+
+	if utf8.RuneCountInString(f.Colour) > 50 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "colour",
+			Error: "La couleur ne doit pas dépasser 50 caractères",
+		})
+	}
+
+	if utf8.RuneCountInString(f.City) > 50 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "city",
+			Error: "La ville ne doit pas dépasser 50 caractères",
+		})
+	}
+
+	if utf8.RuneCountInString(f.Where) > 100 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "where",
+			Error: "Le lieu ne doit pas dépasser 100 caractères",
+		})
+	}
+
+	if utf8.RuneCountInString(f.Additional) > 255 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "additional",
+			Error: "Les informations complémentaires ne doivent pas dépasser 255 caractères",
+		})
+	}
+
+	// A location is required, either coordinates or a city
+	if f.Latitude == nil && f.City == "" {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "city",
+			Error: "Indiquez la ville ou la position où l'animal a été trouvé",
+		})
+	}
+	fieldErr = append(fieldErr, validateCoordinates(f.Latitude, f.Longitude, nil)...)
+
+	if f.FoundAt.IsZero() {
+		f.FoundAt = time.Now()
+	}
+	if f.FoundAt.After(time.Now().Add(time.Hour)) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "found_at",
+			Error: "La date de découverte ne peut pas être dans le futur",
+		})
+	}
+
+	// The owner needs a way to reach the finder
+	if strings.TrimSpace(f.PhoneNumber) != "" {
+		phone, err := normalizePhone(f.PhoneNumber)
+		if err != nil {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "phone_number",
+				Error: err.Error(),
+			})
+		} else {
+			f.PhoneNumber = phone
+		}
+	} else {
+		f.PhoneNumber = ""
+	}
+	if f.Email != "" {
+		email, err := normalizeEmail(f.Email)
+		if err != nil {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "email",
+				Error: err.Error(),
+			})
+		} else {
+			f.Email = email
+		}
+	}
+	if f.PhoneNumber == "" && f.Email == "" {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "phone_number",
+			Error: "Indiquez un numéro de téléphone ou une adresse email",
+		})
+	}
+
+	return fieldErr
+}
+
+// signPhotos fills the temporary links to the photos, which must be preloaded
+func (f *FoundReport) signPhotos() {
+	f.PhotoLinks = []ReportPhotoResponse{}
+	for _, photo := range f.Photos {
+		f.PhotoLinks = append(f.PhotoLinks, photo.ToResponse())
+	}
+}
+
+// sameBreed accepts "Labrador" for "Labrador retriever", finders rarely know the exact breed
+func sameBreed(a, b string) bool {
+	a = strings.ToLower(strings.TrimSpace(a))
+	b = strings.ToLower(strings.TrimSpace(b))
+	if a == "" || b == "" {
+		return false
+	}
+
+	return strings.Contains(a, b) || strings.Contains(b, a)
+}
+
+// speciesNames folds the usual ways to write a species, in French and English
+var speciesNames = map[string]string{
+	"chien":   "chien",
+	"chienne": "chien",
+	"dog":     "chien",
+	"chat":    "chat",
+	"chatte":  "chat",
+	"cat":     "chat",
+	"lapin":   "lapin",
+	"rabbit":  "lapin",
+	"furet":   "furet",
+	"ferret":  "furet",
+}
+
+func normalizeSpecies(species string) string {
+	species = strings.ToLower(strings.TrimSpace(species))
+	if name, ok := speciesNames[species]; ok {
+		return name
+	}
+
+	return species
+}
+
+// matchScore compares a found animal with a lost pet, ok being false when they can't be the same.
+// Species is optional on pets, it only rules out a match when both sides know it.
+func matchScore(found *FoundReport, pet *Pet) (int, bool) {
+	if pet.LostAt == nil {
+		return 0, false
+	}
+
+	foundSpecies, petSpecies := normalizeSpecies(found.Species), normalizeSpecies(pet.Species)
+	if foundSpecies != "" && petSpecies != "" && foundSpecies != petSpecies {
+		return 0, false
+	}
+
+	// Found at most a day before the owner noticed, and within the window
+	if found.FoundAt.Before(pet.LostAt.Add(-24*time.Hour)) || found.FoundAt.After(pet.LostAt.Add(matchWindow)) {
+		return 0, false
+	}
+
+	score := 0
+	switch {
+	case found.Sexe == FoundSexUnknown:
+		score += 5
+	case found.Sexe == pet.Sexe:
+		score += 20
+	default:
+		return 0, false
+	}
+
+	switch {
+	case strings.EqualFold(strings.TrimSpace(found.Breed), strings.TrimSpace(pet.Breed)):
+		score += 40
+	case sameBreed(found.Breed, pet.Breed):
+		score += 25
+	case found.Breed == "":
+		score += 10
+	default:
+		// Finders get breeds wrong, a different one weighs heavily against the match without ruling it out
+		score -= 30
+	}
+
+	if found.Latitude != nil && pet.Lost.LastSeenLatitude != nil {
+		distance := haversineMeters(*found.Latitude, *found.Longitude, *pet.Lost.LastSeenLatitude, *pet.Lost.LastSeenLongitude)
+		switch {
+		case distance <= 5000:
+			score += 30
+		case distance <= 20000:
+			score += 20
+		case distance <= 50000:
+			score += 10
+		default:
+			return 0, false
+		}
+	} else if found.City != "" && strings.Contains(strings.ToLower(pet.Lost.LastSeenLocation), strings.ToLower(found.City)) {
+		score += 15
+	}
+
+	if found.FoundAt.Sub(*pet.LostAt) <= 7*24*time.Hour {
+		score += 10
+	}
+
+	return score, true
+}
+
+// proposeMatch saves a candidate and warns the owner, a pair being proposed only once
+func proposeMatch(r *http.Request, found *FoundReport, pet *Pet, score int) {
+	match := FoundMatch{FoundReportID: found.ID, PetID: pet.ID, Score: score, Status: MatchStatusProposed}
+	result := db.Where(FoundMatch{FoundReportID: found.ID, PetID: pet.ID}).FirstOrCreate(&match)
+	if result.Error != nil {
+		LogErr(r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+
+	notification := ReportNotification{
+		Event:   NotificationEventFoundMatch,
+		PetName: pet.Name,
+		PetSlug: pet.Slug,
+		Match: &MatchNotification{
+			Score:   score,
+			Species: found.Species,
+			Breed:   found.Breed,
+			Colour:  found.Colour,
+			City:    found.City,
+			Where:   found.Where,
+			URL:     fmt.Sprintf("%s/pets/%s/matches", os.Getenv("FRONTEND_URL"), pet.Slug),
+		},
+	}
+	if err := db.First(&notification.Recipient, pet.UserID).Error; err != nil {
+		LogErr(r, err)
+		return
+	}
+	preferences, err := userNotificationPreference(pet.UserID)
+	if err != nil {
+		LogErr(r, err)
+		return
+	}
+	notification.Preferences = preferences
+
+	sendNotification(r, notification)
+}
+
+// matchFoundReport compares a new found animal with every pet currently lost
+func matchFoundReport(r *http.Request, found *FoundReport) {
+	var pets []Pet
+	db.Where("status = ? AND lost_at >= ?", PetStatusLost, found.FoundAt.Add(-matchWindow)).Find(&pets)
+
+	for i := range pets {
+		if score, ok := matchScore(found, &pets[i]); ok && score >= minMatchScore {
+			proposeMatch(r, found, &pets[i], score)
+		}
+	}
+}
+
+// matchLostPet compares a pet just declared lost with the animals found since
+func matchLostPet(r *http.Request, pet *Pet) {
+	if pet.LostAt == nil {
+		return
+	}
+
+	var founds []FoundReport
+	db.Where("found_at >= ?", pet.LostAt.Add(-24*time.Hour)).Find(&founds)
+
+	for i := range founds {
+		if score, ok := matchScore(&founds[i], pet); ok && score >= minMatchScore {
+			proposeMatch(r, &founds[i], pet, score)
+		}
+	}
+}
+
+// GetFoundChallenge hands out the challenge a finder solves before POST /found, no pet carries it there
+func GetFoundChallenge(w http.ResponseWriter, r *http.Request) {
+	var data = struct {
+		Challenge *VerifierChallenge `json:"challenge,omitempty"`
+	}{
+		Challenge: reportVerifier.Challenge(),
+	}
+
+	response := HTTPResponse{
+		Data:   data,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+// CreateFoundReport lets anyone describe an animal found without a tag
+func CreateFoundReport(w http.ResponseWriter, r *http.Request) {
+	fingerprint := reporterFingerprint(r)
+	if ok, retryAfter := reportIPLimiter.Allow("found:" + fingerprint); !ok {
+		respondTooManyRequests(w, r, retryAfter)
+		return
+	}
+
+	var found FoundReport
+	files, err := decodeWithPhotos(w, r, "found", &found)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	// Bots fill every field, pretend it worked so they don't adapt
+	if found.Website != "" {
+		LogDebug(r, "Honeypot filled, found report dropped")
+		response := HTTPResponse{
+			Data:   FoundReport{},
+			Error:  nil,
+			Status: http.StatusCreated,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if err := reportVerifier.Verify(found.Nonce, found.Proof); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "proof",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusForbidden,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if isBlockedReporter(fingerprint, 0) {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "-",
+					Error: "Vous ne pouvez plus signaler d'animal trouvé",
+				},
+			},
+			Status: http.StatusForbidden,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	found.ID = 0
+	found.CreatedAt = time.Time{}
+	found.Fingerprint = fingerprint
+	found.PhotoLinks = nil
+	if errors := found.Validate(); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   found,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	// Decoding images is the expensive part, it only happens once every check passed
+	photos, photoErrors := processReportPhotos(files)
+	if len(photoErrors) > 0 {
+		response := HTTPResponse{
+			Data:   found,
+			Error:  photoErrors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var stored []ReportPhoto
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&found).Error; err != nil {
+			return err
+		}
+
+		for _, photo := range photos {
+			foundPhoto, err := storeFoundPhoto(found.ID, photo)
+			stored = append(stored, foundPhoto)
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&foundPhoto).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		for _, foundPhoto := range stored {
+			if err := storage.Delete(foundPhoto.Key); err != nil {
+				LogErr(r, err)
+			}
+		}
+
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	found.Photos = stored
+	found.signPhotos()
+	matchFoundReport(r, &found)
+
+	response := HTTPResponse{
+		Data:   found,
+		Error:  nil,
+		Status: http.StatusCreated,
+	}
+	RespondJson(w, r, response)
+}
+
+// GetPetMatches lists the found animals proposed for the pet, dismissed ones with ?status=dismissed
+func GetPetMatches(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	query := db.Preload("FoundReport.Photos").Where("pet_id = ?", pet.ID)
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	} else {
+		query = query.Where("status <> ?", MatchStatusDismissed)
+	}
+
+	var matches []FoundMatch
+	query.Order("score desc").Order("created_at desc").Find(&matches)
+	for i := range matches {
+		matches[i].FoundReport.signPhotos()
+	}
+
+	response := HTTPResponse{
+		Data:   matches,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+// UpdatePetMatch lets the owner confirm or dismiss a proposed match
+func UpdatePetMatch(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	var matchRequest FoundMatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&matchRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	status := matchRequest.Status
+	if status != MatchStatusProposed && status != MatchStatusConfirmed && status != MatchStatusDismissed {
+		response := HTTPResponse{
+			Data: matchRequest,
+			Error: FieldErrors{
+				{
+					Field: "status",
+					Error: fmt.Sprintf("Statut inconnu : %s", status),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	matchID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Identifiant de correspondance invalide",
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var match FoundMatch
+	if err := db.Preload("FoundReport.Photos").Where("pet_id = ?", pet.ID).Where("id = ?", matchID).First(&match).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			LogErr(r, err)
+		}
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Correspondance introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	match.Status = status
+	match.FoundReport.signPhotos()
+	if err := db.Model(&match).Update("status", status).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   match,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
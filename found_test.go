@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/gorilla/mux"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchScore(t *testing.T) {
+	lostAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lat, lng := 45.7640, 4.8357
+	// About 2 km and 30 km from the last seen position
+	nearLat, farLat := 45.7820, 46.0340
+
+	lostPet := func(species, breed, sexe string) *Pet {
+		return &Pet{
+			Species: species,
+			Breed:   breed,
+			Sexe:    sexe,
+			LostAt:  &lostAt,
+			Lost:    LostDetails{LastSeenLocation: "Lyon 6e", LastSeenLatitude: &lat, LastSeenLongitude: &lng},
+		}
+	}
+	found := func(species, breed, sexe string, latitude float64, after time.Duration) *FoundReport {
+		return &FoundReport{
+			Species:   species,
+			Breed:     breed,
+			Sexe:      sexe,
+			Latitude:  &latitude,
+			Longitude: &lng,
+			FoundAt:   lostAt.Add(after),
+		}
+	}
+
+	tests := []struct {
+		name  string
+		found *FoundReport
+		pet   *Pet
+		score int
+		ok    bool
+	}{
+		{"same breed nearby", found("chien", "Labrador", "male", nearLat, 24*time.Hour), lostPet("", "Labrador", "male"), 100, true},
+		{"partial breed", found("chien", "labrador", "male", nearLat, 24*time.Hour), lostPet("", "Labrador retriever", "male"), 85, true},
+		{"unknown breed and sex", found("chien", "", "unknown", nearLat, 24*time.Hour), lostPet("", "Labrador", "female"), 55, true},
+		{"cat near a lost labrador", found("chat", "Européen", "male", nearLat, 24*time.Hour), lostPet("", "Labrador", "male"), 30, true},
+		{"cat for a dog", found("chat", "", "male", nearLat, 24*time.Hour), lostPet("chien", "Labrador", "male"), 0, false},
+		{"species in english", found("dog", "Labrador", "male", nearLat, 24*time.Hour), lostPet("chien", "Labrador", "male"), 100, true},
+		{"other sex", found("chien", "Labrador", "female", nearLat, 24*time.Hour), lostPet("", "Labrador", "male"), 0, false},
+		{"farther away", found("chien", "Labrador", "male", farLat, 24*time.Hour), lostPet("", "Labrador", "male"), 80, true},
+		{"too far", found("chien", "Labrador", "male", 47.0, 24*time.Hour), lostPet("", "Labrador", "male"), 0, false},
+		{"weeks later", found("chien", "Labrador", "male", nearLat, 20*24*time.Hour), lostPet("", "Labrador", "male"), 90, true},
+		{"found before it was lost", found("chien", "Labrador", "male", nearLat, -48*time.Hour), lostPet("", "Labrador", "male"), 0, false},
+		{"after the window", found("chien", "Labrador", "male", nearLat, matchWindow+time.Hour), lostPet("", "Labrador", "male"), 0, false},
+		{"pet not lost", found("chien", "Labrador", "male", nearLat, 24*time.Hour), &Pet{Breed: "Labrador", Sexe: "male"}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			score, ok := matchScore(test.found, test.pet)
+			if ok != test.ok || (ok && score != test.score) {
+				t.Errorf("matchScore = %d, %v, want %d, %v", score, ok, test.score, test.ok)
+			}
+		})
+	}
+
+	// The cat must not be proposed to the owner of the labrador
+	if score, _ := matchScore(found("chat", "Européen", "male", nearLat, 24*time.Hour), lostPet("", "Labrador", "male")); score >= minMatchScore {
+		t.Errorf("a cat near a lost labrador scores %d, above the %d threshold", score, minMatchScore)
+	}
+}
+
+func TestMatchScoreByCity(t *testing.T) {
+	lostAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	pet := &Pet{Breed: "Labrador", Sexe: "male", LostAt: &lostAt, Lost: LostDetails{LastSeenLocation: "Parc de la Tête d'Or, Lyon"}}
+
+	score, ok := matchScore(&FoundReport{Species: "chien", Breed: "Labrador", Sexe: "male", City: "lyon", FoundAt: lostAt.Add(time.Hour)}, pet)
+	if !ok || score != 85 {
+		t.Errorf("matchScore = %d, %v, want 85, true", score, ok)
+	}
+}
+
+func TestCreateFoundReportStoresPhotos(t *testing.T) {
+	openTestDB(t, &FoundReport{}, &ReportPhoto{}, &ReporterBlock{}, &User{}, &Pet{})
+	t.Setenv("SCAN_IP_SALT", "salt")
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	previousStorage := storage
+	storage = &localStorage{Dir: t.TempDir()}
+	defer func() { storage = previousStorage }()
+	previousLimiter := reportIPLimiter
+	reportIPLimiter = newRateLimiter(5, time.Minute)
+	defer func() { reportIPLimiter = previousLimiter }()
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, imageWithSize(8, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("found", `{"species":"chien","sexe":"male","city":"Lyon","phone_number":"0612345678"}`)
+	part, _ := form.CreateFormFile("photos", "dog.png")
+	part.Write(encoded.Bytes())
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/found", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = r.WithContext(context.WithValue(r.Context(), "requestID", "test"))
+	w := httptest.NewRecorder()
+
+	CreateFoundReport(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var photos []ReportPhoto
+	db.Find(&photos)
+	if len(photos) != 1 || photos[0].FoundReportID == 0 || photos[0].ReportID != 0 {
+		t.Fatalf("unexpected photos %+v", photos)
+	}
+	if !strings.HasPrefix(photos[0].Key, "found/") || photos[0].Width != 8 || photos[0].Height != 6 {
+		t.Errorf("unexpected photo %+v", photos[0])
+	}
+	if _, err := storage.Get(photos[0].Key); err != nil {
+		t.Errorf("the photo was not stored: %v", err)
+	}
+	if !strings.Contains(w.Body.String(), "/report-photos/") {
+		t.Errorf("the answer lacks a signed link: %s", w.Body)
+	}
+}
+
+func imageWithSize(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, 0, color.RGBA{R: 0xff, A: 0xff})
+	}
+	return img
+}
+
+func TestUpdatePetMatchStaysWithinThePet(t *testing.T) {
+	openTestDB(t, &FoundReport{}, &FoundMatch{}, &ReportPhoto{})
+	db.Create(&FoundReport{Species: "chien", PhoneNumber: "+33612345678"})
+	db.Create(&FoundMatch{FoundReportID: 1, PetID: 1, Score: 50, Status: MatchStatusProposed})
+	db.Create(&FoundMatch{FoundReportID: 1, PetID: 2, Score: 50, Status: MatchStatusProposed})
+
+	update := func(id string) int {
+		r := httptest.NewRequest(http.MethodPut, "/pets/rex/matches/1", strings.NewReader(`{"status":"confirmed"}`))
+		r = mux.SetURLVars(r, map[string]string{"id": id})
+		w := httptest.NewRecorder()
+		UpdatePetMatch(w, r, &Pet{ID: 1})
+		return w.Code
+	}
+
+	if code := update("2) OR (1=1"); code != http.StatusBadRequest {
+		t.Errorf("an injected id answered %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := update("2"); code != http.StatusNotFound {
+		t.Errorf("the match of another pet answered %d, want %d", code, http.StatusNotFound)
+	}
+	if code := update("1"); code != http.StatusOK {
+		t.Errorf("the pet's own match answered %d, want %d", code, http.StatusOK)
+	}
+
+	var other FoundMatch
+	db.First(&other, 2)
+	if other.Status != MatchStatusProposed {
+		t.Errorf("the match of another pet became %s", other.Status)
+	}
+}
+
+func TestCreateFoundReportChecksProofAndBlocks(t *testing.T) {
+	openTestDB(t, &FoundReport{}, &ReportPhoto{}, &ReporterBlock{})
+	t.Setenv("SCAN_IP_SALT", "salt")
+
+	previousLimiter := reportIPLimiter
+	reportIPLimiter = newRateLimiter(5, time.Minute)
+	defer func() { reportIPLimiter = previousLimiter }()
+	previousVerifier := reportVerifier
+	reportVerifier = stubVerifier{}
+	defer func() { reportVerifier = previousVerifier }()
+
+	post := func(proof string) int {
+		body := `{"species":"chien","sexe":"male","city":"Lyon","phone_number":"0612345678","proof":"` + proof + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/found", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r = r.WithContext(context.WithValue(r.Context(), "requestID", "test"))
+		w := httptest.NewRecorder()
+		CreateFoundReport(w, r)
+		return w.Code
+	}
+
+	if code := post("fail"); code != http.StatusForbidden {
+		t.Errorf("a wrong proof answered %d, want %d", code, http.StatusForbidden)
+	}
+
+	db.Create(&ReporterBlock{Fingerprint: reporterFingerprint(httptest.NewRequest(http.MethodPost, "/found", nil))})
+	if code := post(stubVerifierProof); code != http.StatusForbidden {
+		t.Errorf("a blocked finder answered %d, want %d", code, http.StatusForbidden)
+	}
+
+	var count int64
+	db.Model(&FoundReport{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d found reports stored, want none", count)
+	}
+}
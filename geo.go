@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net/http"
+	"time"
+)
+
+const earthRadius = 6371000.0
+
+// postgisEnabled is set at startup when the database can store report locations as geography
+var postgisEnabled bool
+
+// haversineMeters is the great-circle distance between two points
+func haversineMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(lat2 - lat1)
+	dLng := toRad(lng2 - lng1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// validateCoordinates checks an optional position, both coordinates being given together
+func validateCoordinates(latitude, longitude, accuracy *float64) FieldErrors {
+	var fieldErr FieldErrors
+
+	if (latitude == nil) != (longitude == nil) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "latitude",
+			Error: "La latitude et la longitude vont ensemble",
+		})
+		return fieldErr
+	}
+
+	if latitude != nil && (*latitude < -90 || *latitude > 90) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "latitude",
+			Error: "La latitude doit être comprise entre -90 et 90",
+		})
+	}
+	if longitude != nil && (*longitude < -180 || *longitude > 180) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "longitude",
+			Error: "La longitude doit être comprise entre -180 et 180",
+		})
+	}
+	if accuracy != nil && *accuracy < 0 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "accuracy",
+			Error: "La précision ne peut pas être négative",
+		})
+	}
+
+	return fieldErr
+}
+
+// enablePostGIS adds a geography column to reports when the extension can be installed.
+// The plain latitude and longitude columns stay the reference either way.
+func enablePostGIS() {
+	var available int64
+	db.Raw("SELECT count(*) FROM pg_available_extensions WHERE name = 'postgis'").Scan(&available)
+	if available == 0 {
+		log.Info().Msg("PostGIS not available, report locations use plain columns")
+		return
+	}
+
+	statements := []string{
+		"CREATE EXTENSION IF NOT EXISTS postgis",
+		"ALTER TABLE reports ADD COLUMN IF NOT EXISTS location geography(Point, 4326)",
+		"CREATE INDEX IF NOT EXISTS idx_reports_location ON reports USING GIST (location)",
+		"UPDATE reports SET location = ST_SetSRID(ST_MakePoint(longitude, latitude), 4326)::geography WHERE location IS NULL AND latitude IS NOT NULL",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			log.Error().Msg("PostGIS disabled: " + err.Error())
+			return
+		}
+	}
+
+	postgisEnabled = true
+}
+
+// storeReportLocation fills the geography column of a new report
+func storeReportLocation(report *Report) error {
+	if !postgisEnabled || report.Latitude == nil {
+		return nil
+	}
+
+	return db.Exec("UPDATE reports SET location = ST_SetSRID(ST_MakePoint(?, ?), 4326)::geography WHERE id = ?",
+		*report.Longitude, *report.Latitude, report.ID).Error
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// GetPetReportsGeoJSON maps the located sightings of a pet, oldest first, with the distance covered
+func GetPetReportsGeoJSON(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	var reports []Report
+	db.Where("pet_id = ?", pet.ID).Where("latitude IS NOT NULL").Order("created_at").Order("id").Find(&reports)
+
+	collection := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for i, report := range reports {
+		properties := map[string]interface{}{
+			"id":         report.ID,
+			"created_at": report.CreatedAt.Format(time.RFC3339),
+			"has_pet":    report.HasPet,
+			"city":       report.City,
+			"where":      report.Where,
+			"accuracy":   report.Accuracy,
+		}
+		if i > 0 {
+			first, previous := reports[0], reports[i-1]
+			properties["distance_from_first"] = math.Round(haversineMeters(*first.Latitude, *first.Longitude, *report.Latitude, *report.Longitude))
+			properties["distance_from_previous"] = math.Round(haversineMeters(*previous.Latitude, *previous.Longitude, *report.Latitude, *report.Longitude))
+		}
+
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type: "Feature",
+			Geometry: GeoJSONPoint{
+				Type:        "Point",
+				Coordinates: [2]float64{*report.Longitude, *report.Latitude},
+			},
+			Properties: properties,
+		})
+	}
+
+	body, err := json.Marshal(collection)
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusInternalServerError,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	if _, err := w.Write(body); err != nil {
+		LogErr(r, err)
+	}
+}
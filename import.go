@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxImportSize        = 10 << 20
+	importAsyncThreshold = 100
+)
+
+const (
+	ImportJobPending = "pending"
+	ImportJobRunning = "running"
+	ImportJobDone    = "done"
+	ImportJobFailed  = "failed"
+)
+
+// PetImportJob tracks an asynchronous import of a large file
+type PetImportJob struct {
+	ID        string    `gorm:"type:varchar(40);primaryKey" json:"id"`
+	UserID    uint      `gorm:"index" json:"-"`
+	Status    string    `gorm:"type:varchar(10)" json:"status"`
+	Total     int       `json:"total"`
+	Imported  int       `json:"imported"`
+	Error     string    `gorm:"type:text" json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ImportRowError struct {
+	Line   int         `json:"line"`
+	Errors FieldErrors `json:"errors"`
+}
+
+type ImportResult struct {
+	Total    int              `json:"total"`
+	Imported int              `json:"imported"`
+	DryRun   bool             `json:"dry_run"`
+	Errors   []ImportRowError `json:"errors,omitempty"`
+	Pets     []Pet            `json:"pets,omitempty"`
+}
+
+// importRow is a pet read from the file, or the errors of a line that couldn't be read
+type importRow struct {
+	Line   int
+	Pet    Pet
+	Errors FieldErrors
+}
+
+// importFormat picks the parser from the format parameter, then from the Content-Type
+func importFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		return "csv"
+	case strings.HasPrefix(contentType, "application/x-ndjson"),
+		strings.HasPrefix(contentType, "application/jsonl"):
+		return "jsonl"
+	}
+
+	return ""
+}
+
+func parseCSVPets(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	// Rows with a wrong number of columns are reported per line below
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("En-tête CSV illisible : %s", err.Error())
+	}
+
+	columns := make(map[string]int)
+	for i, column := range header {
+		columns[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	for _, required := range []string{"name", "breed", "sexe", "birthdate"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("Colonne CSV manquante : %s", required)
+		}
+	}
+
+	value := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			rows = append(rows, importRow{
+				Line:   line,
+				Errors: FieldErrors{{Field: "-", Error: fmt.Sprintf("La ligne a %d colonnes au lieu de %d", len(record), len(header))}},
+			})
+			continue
+		}
+
+		rows = append(rows, importRow{
+			Line: line,
+			Pet: Pet{
+				Name:      value(record, "name"),
+				Species:   value(record, "species"),
+				Breed:     value(record, "breed"),
+				Sexe:      value(record, "sexe"),
+				Birthdate: value(record, "birthdate"),
+				Photo:     value(record, "photo"),
+			},
+		})
+	}
+
+	return rows, nil
+}
+
+func parseJSONLinesPets(body io.Reader) ([]importRow, error) {
+	var rows []importRow
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportSize)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		// A bad line is reported with the others instead of rejecting the whole file
+		var pet Pet
+		if err := json.Unmarshal([]byte(text), &pet); err != nil {
+			rows = append(rows, importRow{
+				Line:   line,
+				Errors: FieldErrors{{Field: "-", Error: fmt.Sprintf("Ligne illisible : %s", err.Error())}},
+			})
+			continue
+		}
+
+		// Only keep the fields an owner may set on creation
+		rows = append(rows, importRow{
+			Line: line,
+			Pet: Pet{
+				Name:      pet.Name,
+				Species:   pet.Species,
+				Breed:     pet.Breed,
+				Sexe:      pet.Sexe,
+				Birthdate: pet.Birthdate,
+				Photo:     pet.Photo,
+			},
+		})
+	}
+
+	return rows, scanner.Err()
+}
+
+// createImportedPets inserts every row or none
+func createImportedPets(rows []importRow) ([]Pet, error) {
+	pets := make([]Pet, 0, len(rows))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range rows {
+			pet := row.Pet
+			if err := tx.Create(&pet).Error; err != nil {
+				return fmt.Errorf("Ligne %d : %s", row.Line, err.Error())
+			}
+			pets = append(pets, pet)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pets, nil
+}
+
+func runImportJob(job PetImportJob, rows []importRow) {
+	db.Model(&job).Update("status", ImportJobRunning)
+
+	pets, err := createImportedPets(rows)
+	if err != nil {
+		log.Error().Str("ImportJob", job.ID).Msg(err.Error())
+		db.Model(&job).Updates(map[string]interface{}{"status": ImportJobFailed, "error": err.Error()})
+		return
+	}
+
+	db.Model(&job).Updates(map[string]interface{}{"status": ImportJobDone, "imported": len(pets)})
+}
+
+func ImportPets(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	var rows []importRow
+	switch importFormat(r) {
+	case "csv":
+		rows, err = parseCSVPets(body)
+	case "jsonl":
+		rows, err = parseJSONLinesPets(body)
+	default:
+		err = fmt.Errorf("Format inconnu, utilisez CSV ou JSON Lines")
+	}
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "file",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if len(rows) == 0 {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "file",
+					Error: "Le fichier ne contient aucun animal",
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	result := ImportResult{
+		Total:  len(rows),
+		DryRun: r.URL.Query().Get("dry_run") == "true",
+	}
+	for i := range rows {
+		if len(rows[i].Errors) > 0 {
+			result.Errors = append(result.Errors, ImportRowError{
+				Line:   rows[i].Line,
+				Errors: rows[i].Errors,
+			})
+			continue
+		}
+
+		rows[i].Pet.UserID = userID
+		rows[i].Pet.Status = PetStatusHome
+		rows[i].Pet.Privacy = DefaultPetPrivacy()
+
+		if errors := rows[i].Pet.Validate(); len(errors) > 0 {
+			result.Errors = append(result.Errors, ImportRowError{
+				Line:   rows[i].Line,
+				Errors: errors,
+			})
+		}
+	}
+
+	if result.DryRun {
+		response := HTTPResponse{
+			Data:   result,
+			Error:  nil,
+			Status: http.StatusOK,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if len(result.Errors) > 0 {
+		response := HTTPResponse{
+			Data:   result,
+			Error:  result.Errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	// Large files are imported in the background
+	if len(rows) > importAsyncThreshold {
+		job := PetImportJob{
+			ID:     uuid.New().String(),
+			UserID: userID,
+			Status: ImportJobPending,
+			Total:  len(rows),
+		}
+		if err := db.Create(&job).Error; err != nil {
+			LogErr(r, err)
+			response := HTTPResponse{
+				Error: FieldErrors{
+					FieldError{
+						Field: "-",
+						Error: err.Error(),
+					},
+				},
+				Status: http.StatusInternalServerError,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+
+		go runImportJob(job, rows)
+
+		response := HTTPResponse{
+			Data:   job,
+			Error:  nil,
+			Status: http.StatusAccepted,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	pets, err := createImportedPets(rows)
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	result.Imported = len(pets)
+	result.Pets = pets
+	response := HTTPResponse{
+		Data:   result,
+		Error:  nil,
+		Status: http.StatusCreated,
+	}
+	RespondJson(w, r, response)
+}
+
+func GetPetImportJob(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var job PetImportJob
+	if err := db.Where("id = ?", params["id"]).Where("user_id = ?", userID).First(&job).Error; err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Import introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   job,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseJSONLinesPetsKeepsBadLines(t *testing.T) {
+	body := strings.Join([]string{
+		`{"name":"Rex","breed":"Labrador","sexe":"male","birthdate":"2020-01-01"}`,
+		`{"name":"Mia",`,
+		``,
+		`{"name":"Kiki","breed":"Siamois","sexe":"female","birthdate":"2021-05-04"}`,
+	}, "\n")
+
+	rows, err := parseJSONLinesPets(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("%d rows, want 3", len(rows))
+	}
+	if rows[0].Line != 1 || rows[0].Pet.Name != "Rex" || len(rows[0].Errors) > 0 {
+		t.Errorf("unexpected first row %+v", rows[0])
+	}
+	if rows[1].Line != 2 || len(rows[1].Errors) != 1 {
+		t.Errorf("the broken line should be kept with its error, got %+v", rows[1])
+	}
+	if rows[2].Line != 4 || rows[2].Pet.Name != "Kiki" {
+		t.Errorf("unexpected last row %+v", rows[2])
+	}
+}
+
+func TestImportPetsReportsJSONLinesErrorsPerLine(t *testing.T) {
+	t.Setenv("JWT_SECRET_KEY", "secret")
+	token, err := generateJWT(&User{ID: 1, Email: "owner@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := strings.Join([]string{
+		`{"name":"Rex","breed":"Labrador","sexe":"male","birthdate":"2020-01-01"}`,
+		`not json`,
+		`{"name":"","breed":"Siamois","sexe":"female","birthdate":"2021-05-04"}`,
+	}, "\n")
+	r := httptest.NewRequest(http.MethodPost, "/pets/import?format=jsonl&dry_run=true", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	ImportPets(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var response struct {
+		Data ImportResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Data.Total != 3 || len(response.Data.Errors) != 2 {
+		t.Fatalf("unexpected result %+v", response.Data)
+	}
+	if response.Data.Errors[0].Line != 2 || response.Data.Errors[1].Line != 3 {
+		t.Errorf("errors on lines %d and %d, want 2 and 3", response.Data.Errors[0].Line, response.Data.Errors[1].Line)
+	}
+}
+
+func TestParseCSVPetsKeepsRaggedRows(t *testing.T) {
+	body := strings.Join([]string{
+		"name,species,breed,sexe,birthdate",
+		"Rex,Chien,Labrador,male,2020-01-01",
+		"Mia,chat,Siamois",
+		"Kiki,chat,Siamois,female,2021-05-04,extra",
+		"Filou,,Européen,male,2019-03-02",
+	}, "\n")
+
+	rows, err := parseCSVPets(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("%d rows, want 4", len(rows))
+	}
+	if rows[0].Line != 2 || rows[0].Pet.Name != "Rex" || rows[0].Pet.Species != "Chien" || len(rows[0].Errors) > 0 {
+		t.Errorf("unexpected first row %+v", rows[0])
+	}
+	for _, row := range rows[1:3] {
+		if len(row.Errors) != 1 {
+			t.Errorf("the ragged line %d should be kept with its error, got %+v", row.Line, row)
+		}
+	}
+	if rows[3].Line != 5 || rows[3].Pet.Name != "Filou" || len(rows[3].Errors) > 0 {
+		t.Errorf("unexpected last row %+v", rows[3])
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ReportFilterInbox    = "inbox"
+	ReportFilterUnread   = "unread"
+	ReportFilterRead     = "read"
+	ReportFilterArchived = "archived"
+	ReportFilterAll      = "all"
+)
+
+// ReportPage is one page of the owner's reports
+type ReportPage struct {
+	Pagination
+	Total   int64            `json:"total"`
+	Unread  int64            `json:"unread"`
+	Reports []ReportResponse `json:"reports"`
+}
+
+// ReportStateRequest changes the read and archived flags, absent fields are left as they are
+type ReportStateRequest struct {
+	Read     *bool `json:"read"`
+	Archived *bool `json:"archived"`
+}
+
+// userReports scopes reports to the pets of the user still in use
+func userReports(userID uint) *gorm.DB {
+	return db.Model(&Report{}).
+		Joins("JOIN pets ON pets.id = reports.pet_id").
+		Where("pets.user_id = ?", userID).
+		Where("pets.deleted_at IS NULL")
+}
+
+// filterReports applies the status query parameter, the inbox hiding archived reports
+func filterReports(query *gorm.DB, filter string) (*gorm.DB, FieldErrors) {
+	switch filter {
+	case "", ReportFilterInbox:
+		return query.Where("reports.archived_at IS NULL"), nil
+	case ReportFilterUnread:
+		return query.Where("reports.archived_at IS NULL").Where("reports.read_at IS NULL"), nil
+	case ReportFilterRead:
+		return query.Where("reports.archived_at IS NULL").Where("reports.read_at IS NOT NULL"), nil
+	case ReportFilterArchived:
+		return query.Where("reports.archived_at IS NOT NULL"), nil
+	case ReportFilterAll:
+		return query, nil
+	}
+
+	return query, FieldErrors{
+		{
+			Field: "status",
+			Error: "Le statut doit être inbox, unread, read, archived ou all",
+		},
+	}
+}
+
+// respondReportPage sends a page of the reports matched by query, which must build a new query on each call
+func respondReportPage(w http.ResponseWriter, r *http.Request, query func() *gorm.DB) {
+	filter := r.URL.Query().Get("status")
+	reportStatus := r.URL.Query().Get("report_status")
+	if _, ok := reportTransitions[reportStatus]; reportStatus != "" && !ok {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "report_status",
+					Error: "Le statut doit être new, contacted, resolved, reunited ou spam",
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+	if reportStatus != "" {
+		unfiltered := query
+		query = func() *gorm.DB {
+			return unfiltered().Where("reports.status = ?", reportStatus)
+		}
+	}
+
+	filtered, errors := filterReports(query(), filter)
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	page := ReportPage{Pagination: parsePagination(r), Reports: []ReportResponse{}}
+	filtered.Count(&page.Total)
+	query().Where("reports.archived_at IS NULL").Where("reports.read_at IS NULL").Count(&page.Unread)
+
+	// A gorm query can't be reused once counted
+	filtered, _ = filterReports(query(), filter)
+	var reports []Report
+	if err := filtered.Select("reports.*").Preload("Photos").Order("reports.created_at desc").Order("reports.id desc").
+		Offset(page.Offset()).Limit(page.PerPage).Find(&reports).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	for _, report := range reports {
+		page.Reports = append(page.Reports, report.ToResponse())
+	}
+
+	response := HTTPResponse{
+		Data:   page,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+// userReport finds one report of the {id} route variable among the user's reports
+func userReport(r *http.Request) (*Report, int, FieldErrors) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		return nil, http.StatusUnauthorized, FieldErrors{{Field: "jwt", Error: err.Error()}}
+	}
+
+	reportID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, http.StatusBadRequest, FieldErrors{{Field: "id", Error: "Identifiant de signalement invalide"}}
+	}
+
+	var report Report
+	if err := userReports(userID).Select("reports.*").Preload("Photos").First(&report, "reports.id = ?", reportID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, http.StatusNotFound, FieldErrors{{Field: "id", Error: "Signalement introuvable"}}
+		}
+		return nil, http.StatusBadRequest, FieldErrors{{Field: "-", Error: err.Error()}}
+	}
+
+	return &report, http.StatusOK, nil
+}
+
+func GetPetReports(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	respondReportPage(w, r, func() *gorm.DB {
+		return db.Model(&Report{}).Where("reports.pet_id = ?", pet.ID)
+	})
+}
+
+func GetReports(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	respondReportPage(w, r, func() *gorm.DB {
+		return userReports(userID)
+	})
+}
+
+// GetReport shows a report and marks it as read
+func GetReport(w http.ResponseWriter, r *http.Request) {
+	report, status, errors := userReport(r)
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if report.ReadAt == nil {
+		now := time.Now()
+		report.ReadAt = &now
+		if err := db.Model(report).Update("read_at", now).Error; err != nil {
+			LogErr(r, err)
+		}
+	}
+
+	response := HTTPResponse{
+		Data:   report.ToResponse(),
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func UpdateReportState(w http.ResponseWriter, r *http.Request) {
+	report, status, errors := userReport(r)
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var stateRequest ReportStateRequest
+	if err := json.NewDecoder(r.Body).Decode(&stateRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	now := time.Now()
+	toggle := func(value **time.Time, set *bool) {
+		if set == nil {
+			return
+		}
+		if !*set {
+			*value = nil
+		} else if *value == nil {
+			*value = &now
+		}
+	}
+	toggle(&report.ReadAt, stateRequest.Read)
+	toggle(&report.ArchivedAt, stateRequest.Archived)
+
+	err := db.Model(report).Updates(map[string]interface{}{
+		"read_at":     report.ReadAt,
+		"archived_at": report.ArchivedAt,
+	}).Error
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   report.ToResponse(),
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
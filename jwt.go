@@ -7,7 +7,6 @@ import (
 	"github.com/rs/zerolog/log"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 )
 
@@ -99,11 +98,13 @@ func readReportJWTClaims(token *jwt.Token) (*struct {
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if claims["pet_id"] == nil || claims["pet_id"] == "" {
+		// A user token carries no pet_id, it must not pass for a report token
+		id, ok := claims["pet_id"].(float64)
+		if !ok {
 			return nil, fmt.Errorf("Missing required claims")
 		}
 
-		reportToken.id = claims["pet_id"].(float64)
+		reportToken.id = id
 	}
 
 	return &reportToken, nil
@@ -111,9 +112,7 @@ func readReportJWTClaims(token *jwt.Token) (*struct {
 
 func isAuthorized(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		reqToken := r.Header.Get("Authorization")
-		splitToken := strings.Split(reqToken, "Bearer ")
-		reqToken = splitToken[1]
+		reqToken := bearerToken(r)
 		if reqToken == "" {
 			response := HTTPResponse{
 				Error: FieldErrors{
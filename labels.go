@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+const maxLabelSlugs = 500
+
+const (
+	LabelShapeRectangle = "rectangle"
+	LabelShapeRounded   = "rounded"
+	LabelShapeCircle    = "circle"
+)
+
+// LabelTemplate describes a sheet of sticker labels, every dimension is in millimeters
+type LabelTemplate struct {
+	Preset      string  `json:"preset"`
+	PageWidth   float64 `json:"page_width"`
+	PageHeight  float64 `json:"page_height"`
+	Columns     int     `json:"columns"`
+	Rows        int     `json:"rows"`
+	LabelWidth  float64 `json:"label_width"`
+	LabelHeight float64 `json:"label_height"`
+	MarginTop   float64 `json:"margin_top"`
+	MarginLeft  float64 `json:"margin_left"`
+	GapX        float64 `json:"gap_x"`
+	GapY        float64 `json:"gap_y"`
+	Shape       string  `json:"shape"`
+	Outline     bool    `json:"outline"`
+}
+
+type LabelSheetRequest struct {
+	Slugs    []string      `json:"slugs"`
+	Template LabelTemplate `json:"template"`
+}
+
+// Common Avery-style A4 sheets
+var labelPresets = map[string]LabelTemplate{
+	"avery-l7160": {PageWidth: 210, PageHeight: 297, Columns: 3, Rows: 7, LabelWidth: 63.5, LabelHeight: 38.1, MarginTop: 15.15, MarginLeft: 7.2, GapX: 2.5, Shape: LabelShapeRounded},
+	"avery-l7163": {PageWidth: 210, PageHeight: 297, Columns: 2, Rows: 7, LabelWidth: 99.1, LabelHeight: 38.1, MarginTop: 15.15, MarginLeft: 4.65, GapX: 2.5, Shape: LabelShapeRounded},
+	"avery-l7651": {PageWidth: 210, PageHeight: 297, Columns: 5, Rows: 13, LabelWidth: 38.1, LabelHeight: 21.2, MarginTop: 10.7, MarginLeft: 4.75, GapX: 2.5, Shape: LabelShapeRounded},
+	"round-40":    {PageWidth: 210, PageHeight: 297, Columns: 4, Rows: 6, LabelWidth: 40, LabelHeight: 40, MarginTop: 16.5, MarginLeft: 15, GapX: 7, GapY: 7, Shape: LabelShapeCircle},
+}
+
+// resolve applies the preset, explicit fields overriding it
+func (lt LabelTemplate) resolve() LabelTemplate {
+	preset, ok := labelPresets[lt.Preset]
+	if !ok {
+		if lt.PageWidth == 0 && lt.PageHeight == 0 {
+			lt.PageWidth, lt.PageHeight = 210, 297
+		}
+		if lt.Shape == "" {
+			lt.Shape = LabelShapeRectangle
+		}
+		return lt
+	}
+
+	override := func(value *float64, presetValue float64) {
+		if *value == 0 {
+			*value = presetValue
+		}
+	}
+	override(&lt.PageWidth, preset.PageWidth)
+	override(&lt.PageHeight, preset.PageHeight)
+	override(&lt.LabelWidth, preset.LabelWidth)
+	override(&lt.LabelHeight, preset.LabelHeight)
+	override(&lt.MarginTop, preset.MarginTop)
+	override(&lt.MarginLeft, preset.MarginLeft)
+	override(&lt.GapX, preset.GapX)
+	override(&lt.GapY, preset.GapY)
+	if lt.Columns == 0 {
+		lt.Columns = preset.Columns
+	}
+	if lt.Rows == 0 {
+		lt.Rows = preset.Rows
+	}
+	if lt.Shape == "" {
+		lt.Shape = preset.Shape
+	}
+
+	return lt
+}
+
+func (lt *LabelTemplate) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	if lt.Preset != "" {
+		if _, ok := labelPresets[lt.Preset]; !ok {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "template.preset",
+				Error: "Modèle de planche inconnu",
+			})
+			return fieldErr
+		}
+	}
+
+	if lt.Columns < 1 || lt.Rows < 1 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "template.columns",
+			Error: "La planche doit compter au moins une ligne et une colonne",
+		})
+	}
+
+	if lt.LabelWidth < 15 || lt.LabelHeight < 15 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "template.label_width",
+			Error: "Une étiquette doit mesurer au moins 15 mm de côté",
+		})
+	}
+
+	if lt.MarginTop < 0 || lt.MarginLeft < 0 || lt.GapX < 0 || lt.GapY < 0 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "template.margin_top",
+			Error: "Les marges et espacements ne peuvent pas être négatifs",
+		})
+	}
+
+	switch lt.Shape {
+	case LabelShapeRectangle, LabelShapeRounded, LabelShapeCircle:
+	default:
+		fieldErr = append(fieldErr, FieldError{
+			Field: "template.shape",
+			Error: "La forme doit être rectangle, rounded ou circle",
+		})
+	}
+
+	// The grid must fit on the page
+	width := lt.MarginLeft + float64(lt.Columns)*lt.LabelWidth + float64(lt.Columns-1)*lt.GapX
+	height := lt.MarginTop + float64(lt.Rows)*lt.LabelHeight + float64(lt.Rows-1)*lt.GapY
+	if width > lt.PageWidth || height > lt.PageHeight {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "template",
+			Error: "La grille d'étiquettes dépasse de la page",
+		})
+	}
+
+	return fieldErr
+}
+
+// shortURL drops the scheme so the URL fits on a small label
+func shortURL(url string) string {
+	url = strings.TrimPrefix(url, "https://")
+	return strings.TrimPrefix(url, "http://")
+}
+
+// fitText returns the largest font size up to max for which the text fits the width
+func fitText(text string, width, max float64) float64 {
+	size := max
+	for size > 4 && pdfTextWidth(text, size) > width {
+		size -= 0.5
+	}
+
+	return size
+}
+
+// drawLabel lays out a single label, x and y being its top-left corner in points
+func drawLabel(page *pdfPage, template LabelTemplate, pet *Pet, qr int, x, y float64) {
+	w, h := template.LabelWidth*pdfMM, template.LabelHeight*pdfMM
+
+	if template.Outline {
+		switch template.Shape {
+		case LabelShapeCircle:
+			page.Ellipse(x, y, w, h, 0.3)
+		case LabelShapeRounded:
+			page.RoundedRect(x, y, w, h, 3*pdfMM, 0.3)
+		default:
+			page.Rect(x, y, w, h, 0.3)
+		}
+	}
+
+	// Content stays in the square inscribed in a circle
+	padding := 2 * pdfMM
+	if template.Shape == LabelShapeCircle {
+		inner := math.Min(w, h) / math.Sqrt2
+		x, y = x+(w-inner)/2, y+(h-inner)/2
+		w, h = inner, inner
+		padding = 0
+	}
+	x, y = x+padding, y+padding
+	w, h = w-2*padding, h-2*padding
+
+	url := shortURL(pet.QRCode.Url)
+	code := formatTagCode(pet.QRCode.Code)
+
+	// Wide labels get the QR code on the left, the others get the text below it
+	if w >= 1.6*h {
+		page.DrawImage(qr, x, y, h, h)
+		textX, textWidth := x+h+padding, w-h-padding
+		nameSize := fitText(pet.Name, textWidth, 14)
+		urlSize := fitText(url, textWidth, 7)
+		page.Text(textX, y+h/2-nameSize, nameSize, true, pet.Name)
+		page.Text(textX, y+h/2+2, urlSize, false, url)
+		if code != "" {
+			page.Text(textX, y+h/2+urlSize+4, fitText(code, textWidth, 9), true, code)
+		}
+		return
+	}
+
+	// Small labels only have room for the short code, which is easier to type than the URL
+	if code != "" {
+		url = code
+	}
+
+	nameSize := fitText(pet.Name, w, 9)
+	urlSize := fitText(url, w, 5)
+	qrSize := math.Min(w, h-nameSize-urlSize-2)
+	page.DrawImage(qr, x+(w-qrSize)/2, y, qrSize, qrSize)
+	page.TextCentered(x+w/2, y+qrSize+1, nameSize, true, pet.Name)
+	page.TextCentered(x+w/2, y+qrSize+nameSize+2, urlSize, false, url)
+}
+
+// GetPetLabelSheet renders the tags of several pets on sticker sheets
+func GetPetLabelSheet(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var request LabelSheetRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	template := request.Template.resolve()
+	errors := template.Validate()
+	if len(request.Slugs) == 0 || len(request.Slugs) > maxLabelSlugs {
+		errors = append(errors, FieldError{
+			Field: "slugs",
+			Error: fmt.Sprintf("Sélectionnez entre 1 et %d animaux", maxLabelSlugs),
+		})
+	}
+	if len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   template,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var pets []Pet
+	db.Preload("QRCode").Where("user_id = ?", userID).Where("slug IN ?", request.Slugs).Find(&pets)
+	petsBySlug := make(map[string]*Pet)
+	for i := range pets {
+		petsBySlug[pets[i].Slug] = &pets[i]
+	}
+
+	// Every slug must belong to the caller, a slug listed twice prints twice
+	for _, slug := range request.Slugs {
+		if _, ok := petsBySlug[slug]; !ok {
+			errors = append(errors, FieldError{
+				Field: "slugs",
+				Error: fmt.Sprintf("Animal introuvable : %s", slug),
+			})
+		}
+	}
+	if len(errors) > 0 {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	doc := newPDFDocument(template.PageWidth*pdfMM, template.PageHeight*pdfMM)
+
+	// Each QR code is embedded once, whatever the number of copies. Pixels map
+	// to modules so a small image stays sharp once scaled.
+	options := defaultQROptions()
+	options.Size = 128
+	options.Margin = 1
+	qrImages := make(map[string]int)
+	for slug, pet := range petsBySlug {
+		qr, err := renderQRCodeImage(pet.QRCode.Url, options)
+		if err != nil {
+			LogErr(r, err)
+			response := HTTPResponse{
+				Error: FieldErrors{
+					FieldError{
+						Field: "-",
+						Error: err.Error(),
+					},
+				},
+				Status: http.StatusUnprocessableEntity,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+		qrImages[slug] = doc.AddImage(qr)
+	}
+
+	perPage := template.Columns * template.Rows
+	var page *pdfPage
+	for i, slug := range request.Slugs {
+		if i%perPage == 0 {
+			page = doc.AddPage()
+		}
+
+		cell := i % perPage
+		column, row := cell%template.Columns, cell/template.Columns
+		x := (template.MarginLeft + float64(column)*(template.LabelWidth+template.GapX)) * pdfMM
+		y := (template.MarginTop + float64(row)*(template.LabelHeight+template.GapY)) * pdfMM
+
+		drawLabel(page, template, petsBySlug[slug], qrImages[slug], x, y)
+	}
+
+	var out bytes.Buffer
+	if _, err := doc.WriteTo(&out); err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusInternalServerError,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="petcode-labels.pdf"`)
+	if _, err := w.Write(out.Bytes()); err != nil {
+		LogErr(r, err)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	PetStatusHome = "home"
+	PetStatusLost = "lost"
+)
+
+const (
+	ContactChannelPhone = "phone"
+	ContactChannelEmail = "email"
+)
+
+// LostDetails holds what the owner tells finders while the pet is missing
+type LostDetails struct {
+	Message           string   `gorm:"type:varchar(255)" json:"message"`
+	Reward            uint     `json:"reward"`
+	LastSeenLocation  string   `gorm:"type:varchar(100)" json:"last_seen_location"`
+	LastSeenLatitude  *float64 `json:"last_seen_latitude"`
+	LastSeenLongitude *float64 `json:"last_seen_longitude"`
+	ContactChannels   string   `gorm:"type:varchar(50)" json:"contact_channels"`
+}
+
+// PetStatusEvent records every lost/found transition of a pet
+type PetStatusEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	PetID     uint      `gorm:"index" json:"pet_id"`
+	From      string    `gorm:"type:varchar(10)" json:"from"`
+	To        string    `gorm:"type:varchar(10)" json:"to"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type LostRequest struct {
+	Message           string   `json:"message"`
+	Reward            uint     `json:"reward"`
+	LastSeenLocation  string   `json:"last_seen_location"`
+	LastSeenLatitude  *float64 `json:"last_seen_latitude"`
+	LastSeenLongitude *float64 `json:"last_seen_longitude"`
+	ContactChannels   []string `json:"contact_channels"`
+}
+
+type PublicContact struct {
+	Channel string `json:"channel"`
+	Value   string `json:"value"`
+}
+
+type PublicLostInfo struct {
+	UrgentMessage     string          `json:"urgent_message"`
+	LostSince         *time.Time      `json:"lost_since"`
+	Reward            uint            `json:"reward,omitempty"`
+	LastSeenLocation  string          `json:"last_seen_location,omitempty"`
+	LastSeenLatitude  *float64        `json:"last_seen_latitude,omitempty"`
+	LastSeenLongitude *float64        `json:"last_seen_longitude,omitempty"`
+	Contacts          []PublicContact `json:"contacts"`
+}
+
+func (lr *LostRequest) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	if len(lr.Message) > 255 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "message",
+			Error: "Le message ne doit pas dépasser 255 caractères",
+		})
+	}
+
+	if len(lr.LastSeenLocation) > 100 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "last_seen_location",
+			Error: "Le lieu ne doit pas dépasser 100 caractères",
+		})
+	}
+
+	// Coordinates go together
+	if (lr.LastSeenLatitude == nil) != (lr.LastSeenLongitude == nil) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "last_seen_latitude",
+			Error: "La latitude et la longitude doivent être renseignées ensemble",
+		})
+	}
+
+	if lr.LastSeenLatitude != nil && (*lr.LastSeenLatitude < -90 || *lr.LastSeenLatitude > 90) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "last_seen_latitude",
+			Error: "La latitude doit être comprise entre -90 et 90",
+		})
+	}
+
+	if lr.LastSeenLongitude != nil && (*lr.LastSeenLongitude < -180 || *lr.LastSeenLongitude > 180) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "last_seen_longitude",
+			Error: "La longitude doit être comprise entre -180 et 180",
+		})
+	}
+
+	for _, channel := range lr.ContactChannels {
+		if channel != ContactChannelPhone && channel != ContactChannelEmail {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "contact_channels",
+				Error: fmt.Sprintf("Moyen de contact inconnu : %s", channel),
+			})
+		}
+	}
+
+	return fieldErr
+}
+
+func (p *Pet) IsLost() bool {
+	return p.Status == PetStatusLost
+}
+
+// PublicLostInfo builds the lost notice shown to finders, nil when the pet is at home.
+// The owner must be preloaded to resolve the contact channels.
+func (p *Pet) PublicLostInfo() *PublicLostInfo {
+	if !p.IsLost() {
+		return nil
+	}
+
+	// The default message goes through the privacy settings like the rest of the public profile
+	message := p.Lost.Message
+	if message == "" {
+		name := p.ToPublic().Name
+		if name == "" {
+			name = "Cet animal"
+		}
+		message = fmt.Sprintf("%s est perdu(e) ! Merci de contacter son propriétaire au plus vite.", name)
+	}
+
+	return &PublicLostInfo{
+		UrgentMessage:     message,
+		LostSince:         p.LostAt,
+		Reward:            p.Lost.Reward,
+		LastSeenLocation:  p.Lost.LastSeenLocation,
+		LastSeenLatitude:  p.Lost.LastSeenLatitude,
+		LastSeenLongitude: p.Lost.LastSeenLongitude,
+		Contacts:          p.User.contacts(p.Lost.ContactChannels),
+	}
+}
+
+// contacts resolves the channels the owner chose to show, none when they chose nothing:
+// finders can still reach them through a report
+func (u *User) contacts(channels string) []PublicContact {
+	contacts := []PublicContact{}
+	for _, channel := range strings.Split(channels, ",") {
+		switch channel {
+		case ContactChannelPhone:
+			if u.Phone != "" {
+				contacts = append(contacts, PublicContact{Channel: ContactChannelPhone, Value: u.Phone})
+			}
+		case ContactChannelEmail:
+			if u.Email != "" {
+				contacts = append(contacts, PublicContact{Channel: ContactChannelEmail, Value: u.Email})
+			}
+		}
+	}
+
+	return contacts
+}
+
+// changePetStatus saves the pet and records the transition in its history
+func changePetStatus(tx *gorm.DB, pet *Pet, status string) error {
+	event := PetStatusEvent{
+		PetID: pet.ID,
+		From:  pet.Status,
+		To:    status,
+	}
+
+	now := time.Now()
+	pet.Status = status
+	if status == PetStatusLost {
+		pet.LostAt = &now
+		pet.FoundAt = nil
+	} else {
+		pet.FoundAt = &now
+	}
+
+	if err := tx.Save(pet).Error; err != nil {
+		return err
+	}
+
+	return tx.Create(&event).Error
+}
+
+func MarkPetLost(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	var lostRequest LostRequest
+	if err := json.NewDecoder(r.Body).Decode(&lostRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if errors := lostRequest.Validate(); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   lostRequest,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	pet.Lost = LostDetails{
+		Message:           lostRequest.Message,
+		Reward:            lostRequest.Reward,
+		LastSeenLocation:  lostRequest.LastSeenLocation,
+		LastSeenLatitude:  lostRequest.LastSeenLatitude,
+		LastSeenLongitude: lostRequest.LastSeenLongitude,
+		ContactChannels:   strings.Join(lostRequest.ContactChannels, ","),
+	}
+
+	wasLost := pet.IsLost()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if wasLost {
+			// Already lost, only refresh the details
+			return tx.Save(pet).Error
+		}
+		return changePetStatus(tx, pet, PetStatusLost)
+	})
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	// The pet may already be waiting with a finder who reported it without a tag
+	if !wasLost {
+		matchLostPet(r, pet)
+		alertNeighbours(r, pet)
+	}
+
+	response := HTTPResponse{
+		Data:   pet,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func MarkPetFound(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	if !pet.IsLost() {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "status",
+					Error: "Votre animal n'est pas déclaré perdu",
+				},
+			},
+			Status: http.StatusConflict,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return changePetStatus(tx, pet, PetStatusHome)
+	})
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   pet,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func GetPetStatusHistory(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	var events []PetStatusEvent
+	db.Where("pet_id = ?", pet.ID).Order("created_at desc").Find(&events)
+
+	response := HTTPResponse{
+		Data:   events,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPublicLostInfoHidesPrivateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		privacy PetPrivacy
+		message string
+	}{
+		{"name shown", PetPrivacy{ShowName: true}, "Rex est perdu(e) !"},
+		{"name hidden", PetPrivacy{}, "Cet animal est perdu(e) !"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pet := Pet{Name: "Rex", Status: PetStatusLost, Privacy: test.privacy}
+			info := pet.PublicLostInfo()
+			if !strings.HasPrefix(info.UrgentMessage, test.message) {
+				t.Errorf("message %q, want it to start with %q", info.UrgentMessage, test.message)
+			}
+			if !test.privacy.ShowName && strings.Contains(info.UrgentMessage, "Rex") {
+				t.Errorf("the hidden name leaks in %q", info.UrgentMessage)
+			}
+		})
+	}
+}
+
+func TestUserContacts(t *testing.T) {
+	owner := User{Email: "owner@example.com", Phone: "+33612345678"}
+	tests := []struct {
+		name     string
+		owner    User
+		channels string
+		want     []PublicContact
+	}{
+		{"phone", owner, "phone", []PublicContact{{ContactChannelPhone, owner.Phone}}},
+		{"both", owner, "phone,email", []PublicContact{{ContactChannelPhone, owner.Phone}, {ContactChannelEmail, owner.Email}}},
+		{"nothing chosen", owner, "", []PublicContact{}},
+		{"unknown channel", owner, "pigeon", []PublicContact{}},
+		{"chosen but missing", User{Email: owner.Email}, "phone", []PublicContact{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.owner.contacts(test.channels)
+			if len(got) != len(test.want) {
+				t.Fatalf("contacts = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("contacts = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
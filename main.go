@@ -78,10 +78,26 @@ func initialize() {
 		fmt.Println("Connexion established !")
 	}
 
-	if err := db.AutoMigrate(&User{}, &Pet{}, &QRCode{}, &Report{}); err != nil {
+	// QR codes are rendered on demand, drop the images stored by previous versions
+	if db.Migrator().HasColumn(&QRCode{}, "base64") {
+		if err := db.Migrator().DropColumn(&QRCode{}, "base64"); err != nil {
+			log.Fatal().Msg(err.Error())
+		}
+	}
+
+	if err := db.AutoMigrate(&User{}, &Pet{}, &QRCode{}, &Report{}, &PetStatusEvent{}, &MedicalAlert{}, &PetImportJob{}, &ScanEvent{}, &QRCodeRedirect{}, &NotificationPreference{}, &NotificationDelivery{}, &ReportPhoto{}, &ReportStatusEvent{}, &Conversation{}, &RelayMessage{}, &ReporterBlock{}, &FoundReport{}, &FoundMatch{}, &AlertSubscription{}); err != nil {
 		log.Fatal().Msg(err.Error())
 	}
 
+	// Tags printed before tokens existed keep the pet's slug as token
+	if err := db.Exec("UPDATE qr_codes SET token = pets.slug, label = ? FROM pets WHERE qr_codes.pet_id = pets.id AND qr_codes.token IS NULL", defaultTagLabel).Error; err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	if err := backfillTagCodes(); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+	enablePostGIS()
+
 	var users []User
 	db.Find(&users)
 
@@ -171,6 +187,15 @@ func main() {
 	frontUrl := os.Getenv("FRONTEND_URL")
 
 	initialize()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	storage = loadStorage()
+	trustedProxies = loadTrustedProxies()
+	startPetPurgeJob()
+	reportNotifiers = loadReportNotifiers()
+	reportVerifier = loadReportVerifier()
+	resumeDeliveries()
 
 	// Create a CORS handler with the desired CORS options
 	c := cors.New(cors.Options{
@@ -186,6 +211,18 @@ func main() {
 	router.HandleFunc("/signup", signUp).Methods("POST")
 	router.HandleFunc("/pet/{slug}", GetPublicPetBySlug).Methods("GET")
 	router.HandleFunc("/pet/{slug}/report", CreateReport).Methods("POST")
+	router.HandleFunc("/pet/{slug}/photo", GetPublicPetPhoto).Methods("GET")
+	router.HandleFunc("/found", CreateFoundReport).Methods("POST")
+	router.HandleFunc("/found/challenge", GetFoundChallenge).Methods("GET")
+	router.HandleFunc("/alerts/unsubscribe/{token}", GetAlertUnsubscribe).Methods("GET")
+	router.HandleFunc("/alerts/unsubscribe/{token}", UnsubscribeAlerts).Methods("POST")
+	router.HandleFunc("/t/{code}", GetPublicPetByCode).Methods("GET")
+	router.HandleFunc("/r/{token}", RedirectTag).Methods("GET")
+	router.HandleFunc("/report-photos/{id}", GetReportPhoto).Methods("GET")
+	router.HandleFunc("/relay/{token}", relayHandler(finderConversation, RelaySenderFinder, GetConversation)).Methods("GET")
+	router.HandleFunc("/relay/{token}/messages", relayHandler(finderConversation, RelaySenderFinder, PostConversationMessage)).Methods("POST")
+	router.HandleFunc("/relay/{token}/share", relayHandler(finderConversation, RelaySenderFinder, ShareConversationContact)).Methods("POST")
+	router.HandleFunc("/relay/{token}/close", relayHandler(finderConversation, RelaySenderFinder, CloseConversation)).Methods("POST")
 
 	petsRouter := router.PathPrefix("/pets").Subrouter()
 
@@ -194,21 +231,83 @@ func main() {
 	petsRouter.HandleFunc("/", CreatePet).Methods("POST")
 	petsRouter.HandleFunc("/", GetPets).Methods("GET")
 	petsRouter.HandleFunc("", GetPets).Methods("GET")
+	petsRouter.HandleFunc("/trash", GetTrashedPets).Methods("GET")
+	petsRouter.HandleFunc("/import", ImportPets).Methods("POST")
+	petsRouter.HandleFunc("/import/{id}", GetPetImportJob).Methods("GET")
+	petsRouter.HandleFunc("/export", ExportPets).Methods("GET")
+	petsRouter.HandleFunc("/labels.pdf", GetPetLabelSheet).Methods("POST")
 	//petsRouter.HandleFunc("/{id}", GetPetByID).Methods("GET")
-	petsRouter.HandleFunc("/{slug}", GetPetBySlug).Methods("GET")
-	petsRouter.HandleFunc("/{slug}", UpdatePet).Methods("PUT")
-	petsRouter.HandleFunc("/{slug}", DeletePet).Methods("DELETE")
-	petsRouter.HandleFunc("/{slug}/qrcode", GetPetQRCode).Methods("GET")
+	petsRouter.HandleFunc("/{slug}", withPet(PetPermissionRead, GetPetBySlug)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}", withPet(PetPermissionWrite, UpdatePet)).Methods("PUT")
+	petsRouter.HandleFunc("/{slug}", withPet(PetPermissionWrite, DeletePet)).Methods("DELETE")
+	petsRouter.HandleFunc("/{slug}/restore", RestorePet).Methods("POST")
+	petsRouter.HandleFunc("/{slug}/qrcode", withPet(PetPermissionRead, GetPetQRCode, "QRCode")).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/qrcode.png", withPet(PetPermissionRead, GetPetQRCodePNG, "QRCode")).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/qrcode.svg", withPet(PetPermissionRead, GetPetQRCodeSVG, "QRCode")).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/qrcode/branded.png", withPet(PetPermissionRead, GetPetBrandedQRCode, "QRCode")).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/tags", withPet(PetPermissionRead, GetPetTags)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/tags", withPet(PetPermissionWrite, CreatePetTag)).Methods("POST")
+	petsRouter.HandleFunc("/{slug}/tags/{id}/revoke", withPet(PetPermissionWrite, RevokePetTag)).Methods("POST")
+	petsRouter.HandleFunc("/{slug}/tags/{id}/qrcode.png", withPet(PetPermissionRead, GetPetTagQRCodePNG)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/tags/{id}/qrcode.svg", withPet(PetPermissionRead, GetPetTagQRCodeSVG)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/tags/{id}/ndef", withPet(PetPermissionRead, GetPetTagNDEF)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/tags/{id}/tag.ndef", withPet(PetPermissionRead, GetPetTagNDEFFile)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/ndef", withPet(PetPermissionRead, GetPetNDEF, "QRCode")).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/tag.ndef", withPet(PetPermissionRead, GetPetNDEFFile, "QRCode")).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/sheet.pdf", withPet(PetPermissionRead, GetPetSheet, "QRCode", "MedicalAlerts", "User")).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/lost", withPet(PetPermissionWrite, MarkPetLost)).Methods("PUT")
+	petsRouter.HandleFunc("/{slug}/found", withPet(PetPermissionWrite, MarkPetFound)).Methods("PUT")
+	petsRouter.HandleFunc("/{slug}/status-history", withPet(PetPermissionRead, GetPetStatusHistory)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/privacy", withPet(PetPermissionWrite, UpdatePetPrivacy)).Methods("PUT")
+	petsRouter.HandleFunc("/{slug}/reports", withPet(PetPermissionRead, GetPetReports)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/reports.geojson", withPet(PetPermissionRead, GetPetReportsGeoJSON)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/matches", withPet(PetPermissionRead, GetPetMatches)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/matches/{id}", withPet(PetPermissionWrite, UpdatePetMatch)).Methods("PUT")
+	petsRouter.HandleFunc("/{slug}/scans", withPet(PetPermissionRead, GetPetScans)).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/medical-alerts", withPet(PetPermissionRead, GetPetMedicalAlerts, "MedicalAlerts")).Methods("GET")
+	petsRouter.HandleFunc("/{slug}/medical-alerts", withPet(PetPermissionWrite, CreatePetMedicalAlert)).Methods("POST")
+	petsRouter.HandleFunc("/{slug}/medical-alerts/{id}", withPet(PetPermissionWrite, DeletePetMedicalAlert)).Methods("DELETE")
+
+	reportsRouter := router.PathPrefix("/reports").Subrouter()
+	reportsRouter.HandleFunc("", GetReports).Methods("GET")
+	reportsRouter.HandleFunc("/", GetReports).Methods("GET")
+	reportsRouter.HandleFunc("/{id}", GetReport).Methods("GET")
+	reportsRouter.HandleFunc("/{id}", UpdateReportState).Methods("PUT")
+	reportsRouter.HandleFunc("/{id}/deliveries", GetReportDeliveries).Methods("GET")
+	reportsRouter.HandleFunc("/{id}/status", UpdateReportStatus).Methods("PUT")
+	reportsRouter.HandleFunc("/{id}/status-history", GetReportStatusHistory).Methods("GET")
+	reportsRouter.HandleFunc("/{id}/block", BlockReporter).Methods("POST")
+	reportsRouter.HandleFunc("/{id}/conversation", relayHandler(ownerConversation, RelaySenderOwner, GetConversation)).Methods("GET")
+	reportsRouter.HandleFunc("/{id}/conversation/messages", relayHandler(ownerConversation, RelaySenderOwner, PostConversationMessage)).Methods("POST")
+	reportsRouter.HandleFunc("/{id}/conversation/share", relayHandler(ownerConversation, RelaySenderOwner, ShareConversationContact)).Methods("POST")
+	reportsRouter.HandleFunc("/{id}/conversation/close", relayHandler(ownerConversation, RelaySenderOwner, CloseConversation)).Methods("POST")
 
 	usersRouter := router.PathPrefix("/user").Subrouter()
 	usersRouter.HandleFunc("/me", GetUser).Methods("GET")
+	usersRouter.HandleFunc("/dashboard", GetDashboard).Methods("GET")
+	usersRouter.HandleFunc("/scans/stream", StreamScans).Methods("GET")
+	usersRouter.HandleFunc("/notifications", GetNotificationPreference).Methods("GET")
+	usersRouter.HandleFunc("/notifications", UpdateNotificationPreference).Methods("PUT")
+	usersRouter.HandleFunc("/alerts", GetAlertSubscription).Methods("GET")
+	usersRouter.HandleFunc("/alerts", UpdateAlertSubscription).Methods("PUT")
+	usersRouter.HandleFunc("/alerts", DeleteAlertSubscription).Methods("DELETE")
+	usersRouter.HandleFunc("/blocks", GetReporterBlocks).Methods("GET")
+	usersRouter.HandleFunc("/blocks/{id}", DeleteReporterBlock).Methods("DELETE")
+
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.HandleFunc("/blocks", GetReporterBlocks).Methods("GET")
+	adminRouter.HandleFunc("/blocks", CreateGlobalReporterBlock).Methods("POST")
+	adminRouter.HandleFunc("/blocks/{id}", DeleteReporterBlock).Methods("DELETE")
 
 	// Use the CORS handler as middleware for your app
 	handler := c.Handler(router)
 	router.Use(requestIDMiddleware)
 	router.Use(zerologMiddleware)
+	router.Use(legacyRedirectMiddleware)
 	petsRouter.Use(isAuthorized)
 	usersRouter.Use(isAuthorized)
+	reportsRouter.Use(isAuthorized)
+	adminRouter.Use(isAuthorized, isAdmin)
 
 	// Start the HTTP server
 	http.Handle("/", router)
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"testing"
+)
+
+// openTestDB points the package database at a fresh in-memory SQLite with the given models
+func openTestDB(t *testing.T, models ...interface{}) {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	testDB, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testDB.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		if sqlDB, err := testDB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
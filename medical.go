@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	MedicalAlertCondition  = "condition"
+	MedicalAlertMedication = "medication"
+	MedicalAlertAllergy    = "allergy"
+	MedicalAlertDoNotFeed  = "do_not_feed"
+)
+
+// MedicalAlert is a critical piece of health information a finder must know about
+type MedicalAlert struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	PetID     uint      `gorm:"index" json:"pet_id"`
+	Kind      string    `gorm:"type:varchar(20)" json:"kind"`
+	Label     string    `gorm:"type:varchar(100)" json:"label"`
+	Details   string    `gorm:"type:varchar(255)" json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PublicMedicalAlert struct {
+	Kind    string `json:"kind"`
+	Label   string `json:"label"`
+	Details string `json:"details,omitempty"`
+}
+
+func (ma *MedicalAlert) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	// Kind is required
+	switch ma.Kind {
+	case MedicalAlertCondition, MedicalAlertMedication, MedicalAlertAllergy, MedicalAlertDoNotFeed:
+	default:
+		fieldErr = append(fieldErr, FieldError{
+			Field: "kind",
+			Error: "Le type d'alerte doit être condition, medication, allergy ou do_not_feed",
+		})
+	}
+
+	// Label is required
+	if ma.Label == "" || len(ma.Label) > 100 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "label",
+			Error: "Le libellé est obligatoire et ne doit pas dépasser 100 caractères",
+		})
+	}
+
+	if len(ma.Details) > 255 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "details",
+			Error: "Les détails ne doivent pas dépasser 255 caractères",
+		})
+	}
+
+	return fieldErr
+}
+
+func (ma *MedicalAlert) ToPublic() PublicMedicalAlert {
+	return PublicMedicalAlert{
+		Kind:    ma.Kind,
+		Label:   ma.Label,
+		Details: ma.Details,
+	}
+}
+
+func GetPetMedicalAlerts(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	response := HTTPResponse{
+		Data:   pet.MedicalAlerts,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func CreatePetMedicalAlert(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	var alert MedicalAlert
+	if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if errors := alert.Validate(); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   alert,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	alert.ID = 0
+	alert.PetID = pet.ID
+	if err := db.Create(&alert).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   alert,
+		Error:  nil,
+		Status: http.StatusCreated,
+	}
+	RespondJson(w, r, response)
+}
+
+func DeletePetMedicalAlert(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	params := mux.Vars(r)
+	alertID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Identifiant d'alerte invalide",
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	query := db.Where("pet_id = ?", pet.ID).Delete(&MedicalAlert{}, alertID)
+	if query.Error != nil || query.RowsAffected == 0 {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Alerte introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   "L'alerte a bien été supprimée",
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxNDEFText = 100
+
+// NDEF record header flags
+const (
+	ndefMessageBegin = 0x80
+	ndefMessageEnd   = 0x40
+	ndefShortRecord  = 0x10
+	ndefWellKnown    = 0x01
+)
+
+// URI prefixes abbreviated by a single byte in URI records
+var ndefURIPrefixes = []string{"", "http://www.", "https://www.", "http://", "https://"}
+
+// NDEFPayload is the message to write on an NFC tag, hex encoded for NFC apps
+type NDEFPayload struct {
+	URI  string `json:"uri"`
+	Text string `json:"text,omitempty"`
+	Hex  string `json:"hex"`
+	Size int    `json:"size"`
+}
+
+func ndefRecord(buf *bytes.Buffer, recordType string, payload []byte, first, last bool) {
+	header := byte(ndefWellKnown)
+	if first {
+		header |= ndefMessageBegin
+	}
+	if last {
+		header |= ndefMessageEnd
+	}
+
+	if len(payload) < 256 {
+		buf.WriteByte(header | ndefShortRecord)
+		buf.WriteByte(byte(len(recordType)))
+		buf.WriteByte(byte(len(payload)))
+	} else {
+		buf.WriteByte(header)
+		buf.WriteByte(byte(len(recordType)))
+		buf.Write([]byte{byte(len(payload) >> 24), byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload))})
+	}
+	buf.WriteString(recordType)
+	buf.Write(payload)
+}
+
+// encodeNDEF builds a message with a URI record, followed by a French text record when text is set
+func encodeNDEF(uri string, text string) []byte {
+	prefix := 0
+	for i, p := range ndefURIPrefixes {
+		if p != "" && strings.HasPrefix(uri, p) && len(p) > len(ndefURIPrefixes[prefix]) {
+			prefix = i
+		}
+	}
+
+	var buf bytes.Buffer
+	uriPayload := append([]byte{byte(prefix)}, strings.TrimPrefix(uri, ndefURIPrefixes[prefix])...)
+	ndefRecord(&buf, "U", uriPayload, true, text == "")
+
+	if text != "" {
+		// Status byte: UTF-8 and the length of the language code
+		textPayload := append([]byte{2}, "fr"+text...)
+		ndefRecord(&buf, "T", textPayload, false, true)
+	}
+
+	return buf.Bytes()
+}
+
+// nfcTagURL marks the tag URL so that scans coming from NFC are told apart
+func nfcTagURL(tagURL string) string {
+	u, err := url.Parse(tagURL)
+	if err != nil {
+		return tagURL
+	}
+
+	query := u.Query()
+	query.Set("src", ScanSourceNFC)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// respondNDEF sends the NDEF message of a tag, as a binary file or as JSON with its hex dump
+func respondNDEF(w http.ResponseWriter, r *http.Request, tag *QRCode, binary bool) {
+	text := r.URL.Query().Get("text")
+	if utf8.RuneCountInString(text) > maxNDEFText {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "text",
+					Error: fmt.Sprintf("Le texte ne doit pas dépasser %d caractères", maxNDEFText),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	uri := nfcTagURL(tag.Url)
+	message := encodeNDEF(uri, text)
+
+	if !binary {
+		response := HTTPResponse{
+			Data: NDEFPayload{
+				URI:  uri,
+				Text: text,
+				Hex:  strings.ToUpper(hex.EncodeToString(message)),
+				Size: len(message),
+			},
+			Error:  nil,
+			Status: http.StatusOK,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="petcode-%d.ndef"`, tag.ID))
+	if _, err := w.Write(message); err != nil {
+		LogErr(r, err)
+	}
+}
+
+func GetPetNDEF(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	respondNDEF(w, r, &pet.QRCode, false)
+}
+
+func GetPetNDEFFile(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	respondNDEF(w, r, &pet.QRCode, true)
+}
+
+func GetPetTagNDEF(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	tag, err := petTag(r, pet)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "QR code introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	respondNDEF(w, r, tag, false)
+}
+
+func GetPetTagNDEFFile(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	tag, err := petTag(r, pet)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "QR code introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	respondNDEF(w, r, tag, true)
+}
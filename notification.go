@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	NotificationEventReport       = "report.created"
+	NotificationEventRelayMessage = "relay.message"
+	NotificationEventFoundMatch   = "found.match"
+	NotificationEventLostAlert    = "pet.lost_alert"
+)
+
+// ReportNotification is everything the owner needs to act on a finder's report.
+// Relay messages reuse it, the finder being the recipient of the owner's replies, and so do found animal
+// matches and the lost pet alerts sent to neighbours.
+type ReportNotification struct {
+	Event         string                 `json:"-"`
+	Recipient     User                   `json:"-"`
+	Preferences   NotificationPreference `json:"-"`
+	PetName       string                 `json:"pet_name"`
+	PetSlug       string                 `json:"pet_slug"`
+	Report        ReportResponse         `json:"report"`
+	MedicalAlerts []MedicalAlert         `json:"medical_alerts"`
+	Message       *MessageNotification   `json:"message,omitempty"`
+	Match         *MatchNotification     `json:"match,omitempty"`
+	Alert         *LostAlertNotification `json:"alert,omitempty"`
+}
+
+// MessageNotification is a new relay message and where to answer it
+type MessageNotification struct {
+	Sender    string    `json:"sender"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	ReplyURL  string    `json:"reply_url"`
+}
+
+func newReportNotification(pet *Pet, report *Report) (ReportNotification, error) {
+	notification := ReportNotification{
+		Event:   NotificationEventReport,
+		PetName: pet.Name,
+		PetSlug: pet.Slug,
+		Report:  report.ToResponse(),
+	}
+
+	if err := db.First(&notification.Recipient, pet.UserID).Error; err != nil {
+		return notification, err
+	}
+
+	// The owner must be reminded of critical alerts even when they are not public
+	if err := db.Where("pet_id = ?", pet.ID).Find(&notification.MedicalAlerts).Error; err != nil {
+		return notification, err
+	}
+
+	preferences, err := userNotificationPreference(pet.UserID)
+	notification.Preferences = preferences
+
+	return notification, err
+}
+
+func notifyOwner(r *http.Request, notification ReportNotification) {
+	LogDebug(r, fmt.Sprintf("Report notification ready for pet %s with %d medical alert(s)",
+		notification.PetSlug, len(notification.MedicalAlerts)))
+
+	sendNotification(r, notification)
+}
+
+// sendNotification delivers in the background through every channel the recipient enabled
+func sendNotification(r *http.Request, notification ReportNotification) {
+	for _, notifier := range reportNotifiers {
+		if !notification.Preferences.Enabled(notifier.Channel(), notification.Recipient) {
+			continue
+		}
+
+		delivery := NotificationDelivery{
+			ReportID: notification.Report.ID,
+			Event:    notification.Event,
+			Channel:  notifier.Channel(),
+			Status:   DeliveryStatusPending,
+		}
+		if err := db.Create(&delivery).Error; err != nil {
+			LogErr(r, err)
+			continue
+		}
+
+		go deliver(notifier, notification, delivery)
+	}
+}
+
+// ScanNotification tells the owner that one of the pet's tags was just scanned
+type ScanNotification struct {
+	OwnerID  uint      `json:"-"`
+	PetName  string    `json:"pet_name"`
+	PetSlug  string    `json:"pet_slug"`
+	TagLabel string    `json:"tag_label"`
+	Scan     ScanEvent `json:"scan"`
+}
+
+func newScanNotification(pet *Pet, tag *QRCode, scan ScanEvent) ScanNotification {
+	return ScanNotification{
+		OwnerID:  pet.UserID,
+		PetName:  pet.Name,
+		PetSlug:  pet.Slug,
+		TagLabel: tag.Label,
+		Scan:     scan,
+	}
+}
+
+func notifyOwnerOfScan(r *http.Request, notification ScanNotification) {
+	LogDebug(r, fmt.Sprintf("Scan notification ready for pet %s", notification.PetSlug))
+	scanStreams.Publish(notification.OwnerID, notification)
+}
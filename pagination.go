@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// Pagination is read from the page and per_page query parameters, pages start at 1
+type Pagination struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+}
+
+func parsePagination(r *http.Request) Pagination {
+	query := r.URL.Query()
+	pagination := Pagination{Page: 1, PerPage: defaultPerPage}
+
+	if page, err := strconv.Atoi(query.Get("page")); err == nil && page > 0 {
+		pagination.Page = page
+	}
+	if perPage, err := strconv.Atoi(query.Get("per_page")); err == nil && perPage > 0 {
+		pagination.PerPage = perPage
+	}
+	if pagination.PerPage > maxPerPage {
+		pagination.PerPage = maxPerPage
+	}
+
+	return pagination
+}
+
+func (p Pagination) Offset() int {
+	return (p.Page - 1) * p.PerPage
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"image"
+	"io"
+	"strings"
+)
+
+// A4 page size in points
+const (
+	pdfA4Width  = 595.28
+	pdfA4Height = 841.89
+	pdfMM       = 72 / 25.4
+)
+
+// Helvetica advance widths for printable ASCII, in thousandths of the font size
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// pdfDocument is a minimal PDF writer: Helvetica text, strokes and RGB images
+type pdfDocument struct {
+	width  float64
+	height float64
+	pages  []*pdfPage
+	images []pdfImage
+}
+
+type pdfPage struct {
+	doc     *pdfDocument
+	content bytes.Buffer
+	images  []int
+}
+
+type pdfImage struct {
+	width  int
+	height int
+	data   []byte
+}
+
+func newPDFDocument(width, height float64) *pdfDocument {
+	return &pdfDocument{width: width, height: height}
+}
+
+func (d *pdfDocument) AddPage() *pdfPage {
+	page := &pdfPage{doc: d}
+	d.pages = append(d.pages, page)
+	return page
+}
+
+// pdfTextWidth measures a Helvetica string at the given font size
+func pdfTextWidth(text string, size float64) float64 {
+	width := 0
+	for _, c := range text {
+		if c >= 32 && c < 127 {
+			width += helveticaWidths[c-32]
+		} else {
+			width += 556
+		}
+	}
+
+	return float64(width) * size / 1000
+}
+
+func pdfEscape(text string) string {
+	encoded, err := charmap.Windows1252.NewEncoder().String(text)
+	if err != nil {
+		// Keep what can be encoded, drop the rest
+		var b strings.Builder
+		for _, c := range text {
+			if s, err := charmap.Windows1252.NewEncoder().String(string(c)); err == nil {
+				b.WriteString(s)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+		encoded = b.String()
+	}
+
+	replacer := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`, "\r", "", "\n", " ")
+	return replacer.Replace(encoded)
+}
+
+// Text draws a line of text, x and y being the top-left corner in points
+func (p *pdfPage) Text(x, y, size float64, bold bool, text string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+
+	fmt.Fprintf(&p.content, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n",
+		font, size, x, p.doc.height-y-size, pdfEscape(text))
+}
+
+// TextCentered draws text horizontally centered on x
+func (p *pdfPage) TextCentered(x, y, size float64, bold bool, text string) {
+	p.Text(x-pdfTextWidth(text, size)/2, y, size, bold, text)
+}
+
+// Line strokes a segment between two top-left based points
+func (p *pdfPage) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n",
+		width, x1, p.doc.height-y1, x2, p.doc.height-y2)
+}
+
+// Rect strokes a rectangle whose top-left corner is at x, y
+func (p *pdfPage) Rect(x, y, w, h, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f %.2f %.2f re S\n",
+		width, x, p.doc.height-y-h, w, h)
+}
+
+// RoundedRect strokes a rectangle with rounded corners of the given radius
+func (p *pdfPage) RoundedRect(x, y, w, h, radius, width float64) {
+	// Control point distance approximating a quarter circle with a cubic Bézier
+	k := radius * 0.5523
+	top := p.doc.height - y
+	bottom := top - h
+
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m ", width, x+radius, bottom)
+	fmt.Fprintf(&p.content, "%.2f %.2f l %.2f %.2f %.2f %.2f %.2f %.2f c ", x+w-radius, bottom, x+w-radius+k, bottom, x+w, bottom+radius-k, x+w, bottom+radius)
+	fmt.Fprintf(&p.content, "%.2f %.2f l %.2f %.2f %.2f %.2f %.2f %.2f c ", x+w, top-radius, x+w, top-radius+k, x+w-radius+k, top, x+w-radius, top)
+	fmt.Fprintf(&p.content, "%.2f %.2f l %.2f %.2f %.2f %.2f %.2f %.2f c ", x+radius, top, x+radius-k, top, x, top-radius+k, x, top-radius)
+	fmt.Fprintf(&p.content, "%.2f %.2f l %.2f %.2f %.2f %.2f %.2f %.2f c S\n", x, bottom+radius, x, bottom+radius-k, x+radius-k, bottom, x+radius, bottom)
+}
+
+// Ellipse strokes the ellipse inscribed in the box whose top-left corner is at x, y
+func (p *pdfPage) Ellipse(x, y, w, h, width float64) {
+	rx, ry := w/2, h/2
+	cx, cy := x+rx, p.doc.height-y-ry
+	kx, ky := rx*0.5523, ry*0.5523
+
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m ", width, cx+rx, cy)
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f %.2f %.2f c ", cx+rx, cy+ky, cx+kx, cy+ry, cx, cy+ry)
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f %.2f %.2f c ", cx-kx, cy+ry, cx-rx, cy+ky, cx-rx, cy)
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f %.2f %.2f c ", cx-rx, cy-ky, cx-kx, cy-ry, cx, cy-ry)
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f %.2f %.2f c S\n", cx+kx, cy-ry, cx+rx, cy-ky, cx+rx, cy)
+}
+
+// AddImage registers an image in the document so that it can be drawn on many pages.
+// Transparent pixels are flattened on white.
+func (d *pdfDocument) AddImage(img image.Image) int {
+	bounds := img.Bounds()
+	data := make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+	for py := bounds.Min.Y; py < bounds.Max.Y; py++ {
+		for px := bounds.Min.X; px < bounds.Max.X; px++ {
+			r, g, b, a := img.At(px, py).RGBA()
+			white := 0xffff - a
+			data = append(data, byte((r+white)>>8), byte((g+white)>>8), byte((b+white)>>8))
+		}
+	}
+
+	d.images = append(d.images, pdfImage{width: bounds.Dx(), height: bounds.Dy(), data: data})
+	return len(d.images) - 1
+}
+
+// DrawImage draws a registered image in the box whose top-left corner is at x, y
+func (p *pdfPage) DrawImage(index int, x, y, w, h float64) {
+	used := false
+	for _, i := range p.images {
+		used = used || i == index
+	}
+	if !used {
+		p.images = append(p.images, index)
+	}
+
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n",
+		w, h, x, p.doc.height-y-h, index)
+}
+
+// Image draws an image used only once
+func (p *pdfPage) Image(img image.Image, x, y, w, h float64) {
+	p.DrawImage(p.doc.AddImage(img), x, y, w, h)
+}
+
+// WriteTo serializes the document
+func (d *pdfDocument) WriteTo(w io.Writer) (int64, error) {
+	var out bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	stream := func(dict string, data []byte) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n<< %s /Length %d >>\nstream\n", len(offsets), dict, len(data))
+		out.Write(data)
+		out.WriteString("\nendstream\nendobj\n")
+	}
+
+	// Objects 1 to 4 are the catalog, the page tree and the two fonts,
+	// images come next, then a page and its content for each page
+	imagesStart := 5
+	pagesStart := imagesStart + len(d.images)
+
+	out.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+
+	var kids []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", pagesStart+i*2))
+	}
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for _, img := range d.images {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(img.data); err != nil {
+			return 0, err
+		}
+		if err := zw.Close(); err != nil {
+			return 0, err
+		}
+
+		stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+			img.width, img.height), compressed.Bytes())
+	}
+
+	for i, page := range d.pages {
+		var xobjects []string
+		for _, index := range page.images {
+			xobjects = append(xobjects, fmt.Sprintf("/Im%d %d 0 R", index, imagesStart+index))
+		}
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Contents %d 0 R /Resources << /Font << /F1 3 0 R /F2 4 0 R >> /XObject << %s >> >> >>",
+			d.width, d.height, pagesStart+i*2+1, strings.Join(xobjects, " ")))
+		stream("", page.content.Bytes())
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.WriteTo(w)
+}
@@ -2,20 +2,21 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type Pet struct {
 	gorm.Model
 	ID        uint   `gorm:"primaryKey" json:"ID"`
 	Name      string `gorm:"type:varchar(30)" json:"name"`
+	Species   string `gorm:"type:varchar(20)" json:"species"`
 	Breed     string `json:"breed"`
 	Sexe      string `gorm:"type:varchar(10);CHECK(sexe IN ('male', 'female'))" json:"sexe"`
 	Birthdate string `gorm:"type:varchar(12)" json:"birthdate"`
@@ -24,6 +25,17 @@ type Pet struct {
 	User      User   `json:"-"`
 	QRCodeID  uint   `json:"qrcode_id"`
 	QRCode    QRCode `json:"qrcode"`
+
+	Status  string      `gorm:"type:varchar(10);default:'home'" json:"status"`
+	LostAt  *time.Time  `json:"lost_at"`
+	FoundAt *time.Time  `json:"found_at"`
+	Lost    LostDetails `gorm:"embedded;embeddedPrefix:lost_" json:"lost"`
+
+	Photo   string     `gorm:"type:text" json:"photo"`
+	Privacy PetPrivacy `gorm:"embedded;embeddedPrefix:privacy_" json:"privacy"`
+
+	MedicalAlerts []MedicalAlert `gorm:"foreignKey:PetID" json:"medical_alerts,omitempty"`
+	Tags          []QRCode       `gorm:"foreignKey:PetID" json:"tags,omitempty"`
 }
 
 func (p *Pet) BeforeCreate(tx *gorm.DB) (err error) {
@@ -36,14 +48,11 @@ func (p *Pet) AfterSave(tx *gorm.DB) (err error) {
 		return
 	}
 
-	url := fmt.Sprintf("%s/pet/%s", os.Getenv("FRONTEND_URL"), p.Slug)
-	qrCode := QRCode{
-		Url:    url,
-		Base64: GenerateBase64(url),
-		PetID:  p.ID,
+	qrCode, err := issueTag(tx, p.ID, defaultTagLabel)
+	if err != nil {
+		return
 	}
 
-	tx.Create(&qrCode)
 	p.QRCodeID = qrCode.ID
 	tx.Save(p)
 	return
@@ -60,6 +69,15 @@ func (p *Pet) Validate() FieldErrors {
 		})
 	}
 
+	// Species is optional, it spares owners matches with animals of another kind
+	p.Species = strings.ToLower(strings.TrimSpace(p.Species))
+	if utf8.RuneCountInString(p.Species) > 20 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "species",
+			Error: "L'espèce ne doit pas dépasser 20 caractères",
+		})
+	}
+
 	// Breed is required
 	if p.Breed == "" {
 		fieldErr = append(fieldErr, FieldError{
@@ -84,47 +102,18 @@ func (p *Pet) Validate() FieldErrors {
 		})
 	}
 
-	return fieldErr
-}
-
-func UpdatePet(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	petSlug := params["slug"]
-
-	reqToken := r.Header.Get("Authorization")
-	splitToken := strings.Split(reqToken, "Bearer ")
-	reqToken = splitToken[1]
-	// Find user id in JWT token
-	token, err := extractTokenFromJWT(reqToken)
-	if err != nil {
-		response := HTTPResponse{
-			Error: FieldErrors{
-				FieldError{
-					Field: "-",
-					Error: err.Error(),
-				},
-			},
-			Status: http.StatusBadRequest,
-		}
-		RespondJson(w, r, response)
-		return
+	// Photo is optional but must be a base64 image
+	if p.Photo != "" && !isValidBase64Image(p.Photo) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "photo",
+			Error: "La photo doit être une image JPEG ou PNG de moins de 2 Mo",
+		})
 	}
-	userToken, _ := readJWTClaims(token)
 
-	if !isValidUUID(petSlug) {
-		response := HTTPResponse{
-			Error: FieldErrors{
-				{
-					Field: "slug",
-					Error: "L'identifiant de votre animal semble invalide",
-				},
-			},
-			Status: http.StatusBadRequest,
-		}
-		RespondJson(w, r, response)
-		return
-	}
+	return fieldErr
+}
 
+func UpdatePet(w http.ResponseWriter, r *http.Request, existingPet *Pet) {
 	var incomingPet Pet
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&incomingPet); err != nil {
@@ -152,40 +141,25 @@ func UpdatePet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var existingPet Pet
-	query := db.Where("user_id = ?", userToken.id).Where("slug = ?", petSlug).First(&existingPet)
-	if query.Error != nil {
-		response := HTTPResponse{
-			Data: nil,
-			Error: FieldErrors{
-				FieldError{
-					Field: "-",
-					Error: query.Error.Error(),
-				},
-			},
-			Status: http.StatusUnauthorized,
-		}
-		RespondJson(w, r, response)
-		return
-	}
-
 	// Update fields based on the incoming payload
 	existingPet.Name = incomingPet.Name
+	existingPet.Species = incomingPet.Species
 	existingPet.Breed = incomingPet.Breed
 	existingPet.Birthdate = incomingPet.Birthdate
 	existingPet.Sexe = incomingPet.Sexe
+	existingPet.Photo = incomingPet.Photo
 
 	// Begin a new transaction
 	tx := db.Begin()
 
 	// Update the existing Pet record
-	if err := tx.Save(&existingPet).Error; err != nil {
+	if err := tx.Save(existingPet).Error; err != nil {
 		response := HTTPResponse{
 			Data: nil,
 			Error: FieldErrors{
 				FieldError{
 					Field: "-",
-					Error: query.Error.Error(),
+					Error: err.Error(),
 				},
 			},
 			Status: http.StatusUnprocessableEntity,
@@ -241,6 +215,16 @@ func CreatePet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	pet.UserID = uint(userToken.id)
+	pet.Status = PetStatusHome
+	pet.LostAt = nil
+	pet.FoundAt = nil
+	pet.Lost = LostDetails{}
+	pet.Privacy = DefaultPetPrivacy()
+	pet.MedicalAlerts = nil
+	// Tags are issued by AfterSave, a client must not bring or attach its own
+	pet.Tags = nil
+	pet.QRCode = QRCode{}
+	pet.QRCodeID = 0
 	errors := pet.Validate()
 
 	if len(errors) > 0 {
@@ -298,52 +282,7 @@ func GetPets(w http.ResponseWriter, r *http.Request) {
 	RespondJson(w, r, response)
 }
 
-func GetPetBySlug(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	petSlug := params["slug"]
-
-	reqToken := r.Header.Get("Authorization")
-	splitToken := strings.Split(reqToken, "Bearer ")
-	reqToken = splitToken[1]
-	// Find user id in JWT token
-	token, err := extractTokenFromJWT(reqToken)
-	if err != nil {
-		response := HTTPResponse{
-			Error: FieldErrors{
-				FieldError{
-					Field: "-",
-					Error: err.Error(),
-				},
-			},
-			Status: http.StatusBadRequest,
-		}
-		RespondJson(w, r, response)
-		return
-	}
-	userToken, _ := readJWTClaims(token)
-
-	var pet Pet
-	if err := db.Where("slug = ?", petSlug).Where("user_id = ?", userToken.id).First(&pet).Error; err != nil {
-		var status int
-		if err == gorm.ErrRecordNotFound {
-			status = http.StatusNotFound
-		} else {
-			status = http.StatusBadRequest
-		}
-
-		response := HTTPResponse{
-			Data: nil,
-			Error: FieldErrors{
-				FieldError{
-					Field: "-",
-					Error: err.Error(),
-				},
-			},
-			Status: status,
-		}
-		RespondJson(w, r, response)
-		return
-	}
+func GetPetBySlug(w http.ResponseWriter, r *http.Request, pet *Pet) {
 	response := HTTPResponse{
 		Data:   pet,
 		Error:  nil,
@@ -358,29 +297,25 @@ func GetPublicPetBySlug(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	petSlug := params["slug"]
 
-	var pet Pet
-	if err := db.Preload("QRCode").Where("slug = ?", petSlug).First(&pet).Error; err != nil {
-		var status int
-		if err == gorm.ErrRecordNotFound {
-			status = http.StatusNotFound
-		} else {
-			status = http.StatusBadRequest
-		}
+	tag, pet, status, errors := resolvePublicTag(petSlug, "User", "MedicalAlerts")
+	if errors != nil {
 		response := HTTPResponse{
-			Data: nil,
-			Error: FieldErrors{
-				FieldError{
-					Field: "-",
-					Error: err.Error(),
-				},
-			},
+			Data:   nil,
+			Error:  errors,
 			Status: status,
 		}
 		RespondJson(w, r, response)
 		return
 	}
 
-	validToken, err := generateReportJWT(&pet)
+	respondPublicPet(w, r, tag, pet)
+}
+
+// respondPublicPet sends what a finder may see of the pet behind a tag
+func respondPublicPet(w http.ResponseWriter, r *http.Request, tag *QRCode, pet *Pet) {
+	recordScan(r, tag, pet)
+
+	validToken, err := generateReportJWT(pet)
 	if err != nil {
 		response := HTTPResponse{
 			Data: nil,
@@ -397,12 +332,20 @@ func GetPublicPetBySlug(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var data = struct {
-		Token string `json:"token"`
-		Pet   Pet    `json:"pet"`
+		Token            string             `json:"token"`
+		Pet              PublicPet          `json:"pet"`
+		ShowCallToAction bool               `json:"show_call_to_action"`
+		Lost             *PublicLostInfo    `json:"lost,omitempty"`
+		Challenge        *VerifierChallenge `json:"challenge,omitempty"`
 	}{
-		Token: validToken,
-		Pet:   pet,
+		Token:            validToken,
+		Pet:              pet.ToPublic(),
+		ShowCallToAction: pet.IsLost(),
+		Lost:             pet.PublicLostInfo(),
+		Challenge:        reportVerifier.Challenge(),
 	}
+	// Finders only know the tag, never the pet's own slug
+	data.Pet.Slug = tag.Token
 
 	response := HTTPResponse{
 		Data:   data,
@@ -449,27 +392,23 @@ func GetPetByID(w http.ResponseWriter, r *http.Request) {
 	RespondJson(w, r, response)
 }
 
-func DeletePet(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	petID := params["slug"]
-
-	if !isValidUUID(petID) {
+func DeletePet(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	// Soft delete the pet record
+	if err := db.Delete(pet).Error; err != nil {
+		LogErr(r, err)
 		response := HTTPResponse{
 			Error: FieldErrors{
-				{
-					Field: "slug",
-					Error: "L'identifiant de votre animal semble invalide",
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
 				},
 			},
-			Status: http.StatusBadRequest,
+			Status: http.StatusInternalServerError,
 		}
 		RespondJson(w, r, response)
 		return
 	}
 
-	// Soft delete the pet record
-	db.Where("slug = ?", petID).Delete(&Pet{})
-
 	response := HTTPResponse{
 		Data:   "L'enregistrement a bien été supprimé",
 		Error:  nil,
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreatePetIgnoresClientTags(t *testing.T) {
+	openTestDB(t, &User{}, &Pet{}, &QRCode{}, &MedicalAlert{})
+	t.Setenv("JWT_SECRET_KEY", "secret")
+	token, err := generateJWT(&User{ID: 1, Email: "owner@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tag of another pet, which the new pet must not take over
+	db.Create(&QRCode{Token: "other", Code: "AAAA1111", PetID: 42, Status: TagStatusActive})
+
+	body := `{"name":"Rex","breed":"Labrador","sexe":"male","birthdate":"2020-01-01",` +
+		`"qrcode_id":1,"qrcode":{"token":"forged","code":"BBBB2222"},"tags":[{"token":"mine","code":"CCCC3333"}]}`
+	r := httptest.NewRequest(http.MethodPost, "/pets", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	CreatePet(w, r)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var pet Pet
+	db.First(&pet)
+	var tags []QRCode
+	db.Where("pet_id = ?", pet.ID).Find(&tags)
+	if len(tags) != 1 || tags[0].ID == 1 || pet.QRCodeID != tags[0].ID {
+		t.Fatalf("the pet holds tag %d and tags %+v, want a single issued tag", pet.QRCodeID, tags)
+	}
+	if tags[0].Token == "forged" || tags[0].Token == "mine" {
+		t.Errorf("the client chose the tag token %q", tags[0].Token)
+	}
+	var count int64
+	db.Model(&QRCode{}).Count(&count)
+	if count != 2 {
+		t.Errorf("%d tags stored, want the other pet's and the issued one", count)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+)
+
+type PetPermission int
+
+const (
+	PetPermissionRead PetPermission = iota
+	PetPermissionWrite
+)
+
+// PetHandlerFunc is a handler scoped to a pet the caller is allowed to access
+type PetHandlerFunc func(w http.ResponseWriter, r *http.Request, pet *Pet)
+
+// bearerToken returns the JWT of the Authorization header, empty when missing
+func bearerToken(r *http.Request) string {
+	reqToken := r.Header.Get("Authorization")
+	if !strings.HasPrefix(reqToken, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimPrefix(reqToken, "Bearer ")
+}
+
+// currentUserID reads the authenticated user from the request JWT
+func currentUserID(r *http.Request) (uint, error) {
+	token, err := extractTokenFromJWT(bearerToken(r))
+	if err != nil {
+		return 0, err
+	}
+
+	userToken, err := readJWTClaims(token)
+	if err != nil {
+		return 0, err
+	}
+	if userToken.id == 0 {
+		return 0, fmt.Errorf("Jeton d'authentification invalide")
+	}
+
+	return uint(userToken.id), nil
+}
+
+// canAccessPet tells whether the user holds the permission on the pet.
+// Only owners are allowed for now, whatever the permission.
+func canAccessPet(userID uint, pet *Pet, permission PetPermission) bool {
+	return pet.UserID == userID
+}
+
+// withPet resolves the pet of the {slug} route variable and checks the caller's permission on it.
+// Missing pets answer 404 and pets of other users answer 403.
+func withPet(permission PetPermission, handler PetHandlerFunc, preloads ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		petSlug := mux.Vars(r)["slug"]
+
+		userID, err := currentUserID(r)
+		if err != nil {
+			response := HTTPResponse{
+				Error: FieldErrors{
+					{
+						Field: "jwt",
+						Error: err.Error(),
+					},
+				},
+				Status: http.StatusUnauthorized,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+
+		if !isValidUUID(petSlug) {
+			response := HTTPResponse{
+				Error: FieldErrors{
+					{
+						Field: "slug",
+						Error: "L'identifiant de votre animal semble invalide",
+					},
+				},
+				Status: http.StatusBadRequest,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+
+		query := db
+		for _, preload := range preloads {
+			query = query.Preload(preload)
+		}
+
+		var pet Pet
+		if err := query.Where("slug = ?", petSlug).First(&pet).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				response := HTTPResponse{
+					Error: FieldErrors{
+						{
+							Field: "slug",
+							Error: "Animal introuvable",
+						},
+					},
+					Status: http.StatusNotFound,
+				}
+				RespondJson(w, r, response)
+				return
+			}
+
+			LogErr(r, err)
+			response := HTTPResponse{
+				Error: FieldErrors{
+					FieldError{
+						Field: "-",
+						Error: err.Error(),
+					},
+				},
+				Status: http.StatusInternalServerError,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+
+		if !canAccessPet(userID, &pet, permission) {
+			LogDebug(r, fmt.Sprintf("User %d denied access to pet %s", userID, pet.Slug))
+			response := HTTPResponse{
+				Error: FieldErrors{
+					{
+						Field: "slug",
+						Error: "Vous n'avez pas accès à cet animal",
+					},
+				},
+				Status: http.StatusForbidden,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+
+		handler(w, r, &pet)
+	}
+}
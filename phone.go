@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const defaultCountryCode = "33"
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+// normalizePhone turns a phone number into E.164, numbers without a country code being French:
+// "06 12 34 56 78", "+33 6 12 34 56 78" and "0033612345678" all become "+33612345678"
+func normalizePhone(phone string) (string, error) {
+	cleaned := strings.NewReplacer(" ", "", ".", "", "-", "", "(", "", ")", "", " ", "").Replace(strings.TrimSpace(phone))
+
+	switch {
+	case strings.HasPrefix(cleaned, "+"):
+	case strings.HasPrefix(cleaned, "00"):
+		cleaned = "+" + cleaned[2:]
+	case strings.HasPrefix(cleaned, "0"):
+		cleaned = "+" + defaultCountryCode + cleaned[1:]
+	default:
+		cleaned = "+" + defaultCountryCode + cleaned
+	}
+
+	// The trunk 0 is sometimes kept after the country code: +33 (0)6...
+	if strings.HasPrefix(cleaned, "+"+defaultCountryCode+"0") {
+		cleaned = "+" + defaultCountryCode + cleaned[len(defaultCountryCode)+2:]
+	}
+
+	if !e164Pattern.MatchString(cleaned) {
+		return "", fmt.Errorf("Le numéro de téléphone n'est pas valide")
+	}
+	if strings.HasPrefix(cleaned, "+"+defaultCountryCode) && len(cleaned) != len(defaultCountryCode)+10 {
+		return "", fmt.Errorf("Le numéro de téléphone n'est pas valide")
+	}
+
+	return cleaned, nil
+}
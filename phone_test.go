@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		want  string
+		valid bool
+	}{
+		{"06 12 34 56 78", "+33612345678", true},
+		{"06.12.34.56.78", "+33612345678", true},
+		{"06-12-34-56-78", "+33612345678", true},
+		{"612345678", "+33612345678", true},
+		{"+33 6 12 34 56 78", "+33612345678", true},
+		{"+33 (0)6 12 34 56 78", "+33612345678", true},
+		{"0033 6 12 34 56 78", "+33612345678", true},
+		{"0033 (0)6 12 34 56 78", "+33612345678", true},
+		{"+33\u00a06\u00a012\u00a034\u00a056\u00a078", "+33612345678", true},
+		{"+44 20 7946 0958", "+442079460958", true},
+		{"+1 (415) 555-2671", "+14155552671", true},
+		{"0049 30 1234567", "+49301234567", true},
+		{"", "", false},
+		{"06 12 34", "", false},
+		{"06 12 34 56 78 90", "", false},
+		{"+33 6 12 34 56 7", "", false},
+		{"06 12 AB 56 78", "", false},
+		{"+0 123 456 789", "", false},
+		{"+1234567890123456", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.phone, func(t *testing.T) {
+			got, err := normalizePhone(test.phone)
+			if test.valid && (err != nil || got != test.want) {
+				t.Errorf("normalizePhone(%q) = %q, %v, want %q", test.phone, got, err, test.want)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("normalizePhone(%q) = %q, want an error", test.phone, got)
+			}
+		})
+	}
+}
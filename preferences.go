@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// NotificationPreference holds the channels through which a user wants to hear about reports
+type NotificationPreference struct {
+	ID            uint   `gorm:"primaryKey" json:"-"`
+	UserID        uint   `gorm:"uniqueIndex" json:"-"`
+	Email         bool   `json:"email"`
+	SMS           bool   `json:"sms"`
+	Webhook       bool   `json:"webhook"`
+	WebhookURL    string `gorm:"type:varchar(255)" json:"webhook_url"`
+	WebhookSecret string `gorm:"type:varchar(64)" json:"webhook_secret"`
+}
+
+type NotificationPreferenceRequest struct {
+	Email               bool   `json:"email"`
+	SMS                 bool   `json:"sms"`
+	Webhook             bool   `json:"webhook"`
+	WebhookURL          string `json:"webhook_url"`
+	RotateWebhookSecret bool   `json:"rotate_webhook_secret"`
+}
+
+func (npr *NotificationPreferenceRequest) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	if npr.WebhookURL != "" {
+		u, err := url.Parse(npr.WebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "webhook_url",
+				Error: "L'URL du webhook doit être une adresse https valide",
+			})
+		} else if err := checkWebhookHost(u.Hostname()); err != nil {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "webhook_url",
+				Error: err.Error(),
+			})
+		}
+	}
+
+	if npr.Webhook && npr.WebhookURL == "" {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "webhook_url",
+			Error: "Renseignez l'URL du webhook pour l'activer",
+		})
+	}
+
+	return fieldErr
+}
+
+// Enabled tells whether the channel is wanted and the owner can be reached through it
+func (np *NotificationPreference) Enabled(channel string, owner User) bool {
+	switch channel {
+	case NotificationChannelEmail:
+		return np.Email && owner.Email != ""
+	case NotificationChannelSMS:
+		return np.SMS && owner.Phone != ""
+	case NotificationChannelWebhook:
+		return np.Webhook && np.WebhookURL != "" && np.WebhookSecret != ""
+	}
+
+	return false
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// userNotificationPreference returns the preferences of the user, email only when never set
+func userNotificationPreference(userID uint) (NotificationPreference, error) {
+	preference := NotificationPreference{UserID: userID, Email: true}
+	err := db.Where(NotificationPreference{UserID: userID}).Attrs(preference).FirstOrInit(&preference).Error
+
+	return preference, err
+}
+
+func GetNotificationPreference(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	preference, err := userNotificationPreference(userID)
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   preference,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func UpdateNotificationPreference(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var preferenceRequest NotificationPreferenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&preferenceRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if errors := preferenceRequest.Validate(); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   preferenceRequest,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	preference, err := userNotificationPreference(userID)
+	if err == nil && (preference.WebhookSecret == "" || preferenceRequest.RotateWebhookSecret) {
+		preference.WebhookSecret, err = newWebhookSecret()
+	}
+	if err == nil {
+		preference.Email = preferenceRequest.Email
+		preference.SMS = preferenceRequest.SMS
+		preference.Webhook = preferenceRequest.Webhook
+		preference.WebhookURL = preferenceRequest.WebhookURL
+		err = db.Save(&preference).Error
+	}
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   preference,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const maxPhotoSize = 2 << 20
+
+// PetPrivacy decides which fields a finder sees on the public scan page
+type PetPrivacy struct {
+	ShowName           bool `gorm:"default:true" json:"show_name"`
+	ShowPhoto          bool `gorm:"default:false" json:"show_photo"`
+	ShowBreed          bool `gorm:"default:false" json:"show_breed"`
+	ShowMedicalAlerts  bool `gorm:"default:false" json:"show_medical_alerts"`
+	ShowOwnerFirstname bool `gorm:"default:false" json:"show_owner_firstname"`
+	ShowContactPhone   bool `gorm:"default:false" json:"show_contact_phone"`
+}
+
+// PublicPet is the only representation of a pet exposed to finders
+type PublicPet struct {
+	Slug           string `json:"slug"`
+	Status         string `json:"status"`
+	Name           string `json:"name,omitempty"`
+	Photo          string `json:"photo,omitempty"`
+	Breed          string `json:"breed,omitempty"`
+	OwnerFirstname string `json:"owner_firstname,omitempty"`
+	ContactPhone   string `json:"contact_phone,omitempty"`
+
+	MedicalAlerts []PublicMedicalAlert `json:"medical_alerts,omitempty"`
+}
+
+// DefaultPetPrivacy is the minimum safe subset: only the pet's name is public
+func DefaultPetPrivacy() PetPrivacy {
+	return PetPrivacy{ShowName: true}
+}
+
+// ToPublic filters the pet through its privacy settings.
+// The owner and medical alerts must be preloaded to be exposed.
+func (p *Pet) ToPublic() PublicPet {
+	public := PublicPet{
+		Slug:   p.Slug,
+		Status: p.Status,
+	}
+
+	if p.Privacy.ShowName {
+		public.Name = p.Name
+	}
+	if p.Privacy.ShowPhoto {
+		public.Photo = p.Photo
+	}
+	if p.Privacy.ShowBreed {
+		public.Breed = p.Breed
+	}
+	if p.Privacy.ShowOwnerFirstname {
+		public.OwnerFirstname = p.User.Firstname
+	}
+	if p.Privacy.ShowContactPhone {
+		public.ContactPhone = p.User.Phone
+	}
+	if p.Privacy.ShowMedicalAlerts {
+		for _, alert := range p.MedicalAlerts {
+			public.MedicalAlerts = append(public.MedicalAlerts, alert.ToPublic())
+		}
+	}
+
+	return public
+}
+
+// decodeBase64Image accepts raw base64 as well as data URLs as sent by browsers
+func decodeBase64Image(encoded string) ([]byte, error) {
+	if i := strings.Index(encoded, ";base64,"); strings.HasPrefix(encoded, "data:") && i > 0 {
+		encoded = encoded[i+len(";base64,"):]
+	}
+
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+func isValidBase64Image(encoded string) bool {
+	raw, err := decodeBase64Image(encoded)
+	if err != nil || len(raw) > maxPhotoSize {
+		return false
+	}
+
+	contentType := http.DetectContentType(raw)
+	return contentType == "image/jpeg" || contentType == "image/png"
+}
+
+// publicPetPhotoURL links to the photo of the pet behind a tag, served by the backend at API_URL
+func publicPetPhotoURL(token string) string {
+	base := os.Getenv("API_URL")
+	if base == "" {
+		base = os.Getenv("QR_BASE_URL")
+	}
+	if base == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s/pet/%s/photo", strings.TrimSuffix(base, "/"), token)
+}
+
+// GetPublicPetPhoto serves the photo of the pet behind a tag, when the owner made it public
+func GetPublicPetPhoto(w http.ResponseWriter, r *http.Request) {
+	_, pet, status, errors := resolvePublicTag(mux.Vars(r)["slug"])
+	if errors == nil && (!pet.Privacy.ShowPhoto || pet.Photo == "") {
+		status, errors = http.StatusNotFound, FieldErrors{{Field: "photo", Error: "Photo introuvable"}}
+	}
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	data, err := decodeBase64Image(pet.Photo)
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error:  FieldErrors{{Field: "photo", Error: "Photo illisible"}},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if _, err := w.Write(data); err != nil {
+		LogErr(r, err)
+	}
+}
+
+func UpdatePetPrivacy(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	var privacy PetPrivacy
+	if err := json.NewDecoder(r.Body).Decode(&privacy); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	pet.Privacy = privacy
+	if err := db.Save(pet).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   pet.Privacy,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
@@ -1,51 +1,270 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"github.com/gorilla/mux"
 	"github.com/skip2/go-qrcode"
 	"gorm.io/gorm"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	minQRCodeSize = 64
+	maxQRCodeSize = 2048
+	maxQRMargin   = 16
+)
+
+// QRCode is a physical tag of a pet, several tags may point to the same pet
 type QRCode struct {
 	gorm.Model
-	Url    string `json:"url"`
-	Base64 string `json:"base64"`
-	PetID  uint   `json:"pet_id"`
+	Url       string     `json:"url"`
+	Base64    string     `gorm:"-" json:"base64,omitempty"`
+	PetID     uint       `json:"pet_id"`
+	Token     string     `gorm:"type:varchar(40);uniqueIndex" json:"token"`
+	Code      string     `gorm:"type:varchar(8);uniqueIndex" json:"code"`
+	Label     string     `gorm:"type:varchar(30)" json:"label"`
+	Status    string     `gorm:"type:varchar(10);default:'active'" json:"status"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// QROptions describes how a QR code is rendered, the margin being counted in modules
+type QROptions struct {
+	Size       int
+	Level      qrcode.RecoveryLevel
+	Margin     int
+	Foreground color.RGBA
+	Background color.RGBA
+}
+
+func defaultQROptions() QROptions {
+	return QROptions{
+		Size:       256,
+		Level:      qrcode.Medium,
+		Margin:     4,
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+}
+
+func GenerateBase64(url string) (string, error) {
+	png, err := renderQRCodePNG(url, defaultQROptions())
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(png), nil
+}
+
+// parseHexColor reads #rgb or #rrggbb colors, the hash being optional
+func parseHexColor(value string) (color.RGBA, bool) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) == 3 {
+		value = string([]byte{value[0], value[0], value[1], value[1], value[2], value[2]})
+	}
+	if len(value) != 6 {
+		return color.RGBA{}, false
+	}
+
+	raw, err := hex.DecodeString(value)
+	if err != nil {
+		return color.RGBA{}, false
+	}
+
+	return color.RGBA{R: raw[0], G: raw[1], B: raw[2], A: 0xff}, true
+}
+
+func parseQROptions(query url.Values) (QROptions, FieldErrors) {
+	var fieldErr FieldErrors
+	options := defaultQROptions()
+
+	if size := query.Get("size"); size != "" {
+		value, err := strconv.Atoi(size)
+		if err != nil || value < minQRCodeSize || value > maxQRCodeSize {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "size",
+				Error: fmt.Sprintf("La taille doit être comprise entre %d et %d pixels", minQRCodeSize, maxQRCodeSize),
+			})
+		}
+		options.Size = value
+	}
+
+	if level := query.Get("level"); level != "" {
+		switch strings.ToUpper(level) {
+		case "L":
+			options.Level = qrcode.Low
+		case "M":
+			options.Level = qrcode.Medium
+		case "Q":
+			options.Level = qrcode.High
+		case "H":
+			options.Level = qrcode.Highest
+		default:
+			fieldErr = append(fieldErr, FieldError{
+				Field: "level",
+				Error: "Le niveau de correction doit être L, M, Q ou H",
+			})
+		}
+	}
+
+	if margin := query.Get("margin"); margin != "" {
+		value, err := strconv.Atoi(margin)
+		if err != nil || value < 0 || value > maxQRMargin {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "margin",
+				Error: fmt.Sprintf("La marge doit être comprise entre 0 et %d modules", maxQRMargin),
+			})
+		}
+		options.Margin = value
+	}
+
+	if fg := query.Get("fg"); fg != "" {
+		value, ok := parseHexColor(fg)
+		if !ok {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "fg",
+				Error: "La couleur doit être au format hexadécimal, par exemple 000000",
+			})
+		}
+		options.Foreground = value
+	}
+
+	if bg := query.Get("bg"); bg != "" {
+		value, ok := parseHexColor(bg)
+		if !ok {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "bg",
+				Error: "La couleur doit être au format hexadécimal, par exemple ffffff",
+			})
+		}
+		options.Background = value
+	}
+
+	return options, fieldErr
+}
+
+// qrMatrix returns the modules of the QR code surrounded by the requested margin
+func qrMatrix(content string, options QROptions) ([][]bool, error) {
+	code, err := qrcode.New(content, options.Level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+
+	bitmap := code.Bitmap()
+	total := len(bitmap) + 2*options.Margin
+	matrix := make([][]bool, total)
+	for y := range matrix {
+		matrix[y] = make([]bool, total)
+	}
+	for y, row := range bitmap {
+		copy(matrix[y+options.Margin][options.Margin:], row)
+	}
+
+	return matrix, nil
+}
+
+// renderQRCodeImage draws the QR code centered on a square of the requested size
+func renderQRCodeImage(content string, options QROptions) (*image.RGBA, error) {
+	matrix, err := qrMatrix(content, options)
+	if err != nil {
+		return nil, err
+	}
+
+	scale := options.Size / len(matrix)
+	if scale < 1 {
+		return nil, fmt.Errorf("La taille est trop petite pour ce QR code")
+	}
+	offset := (options.Size - scale*len(matrix)) / 2
+
+	img := image.NewRGBA(image.Rect(0, 0, options.Size, options.Size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: options.Background}, image.Point{}, draw.Src)
+
+	for y, row := range matrix {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetRGBA(offset+x*scale+dx, offset+y*scale+dy, options.Foreground)
+				}
+			}
+		}
+	}
+
+	return img, nil
+}
+
+func renderQRCodePNG(content string, options QROptions) ([]byte, error) {
+	img, err := renderQRCodeImage(content, options)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
 }
 
-func GenerateBase64(url string) string {
-	png, err := qrcode.Encode(url, qrcode.Medium, 256)
+func renderQRCodeSVG(content string, options QROptions) ([]byte, error) {
+	matrix, err := qrMatrix(content, options)
 	if err != nil {
-		fmt.Println("Could not generate QR code:", err)
-		return ""
+		return nil, err
+	}
+
+	hexColor := func(c color.RGBA) string {
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
 	}
 
-	return base64.StdEncoding.EncodeToString(png)
+	var out bytes.Buffer
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		options.Size, options.Size, len(matrix), len(matrix))
+	fmt.Fprintf(&out, `<rect width="100%%" height="100%%" fill="%s"/>`, hexColor(options.Background))
+	fmt.Fprintf(&out, `<path fill="%s" d="`, hexColor(options.Foreground))
+	for y, row := range matrix {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&out, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	out.WriteString(`"/></svg>`)
+
+	return out.Bytes(), nil
 }
 
-func GetPetQRCode(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	petSlug := params["slug"]
-	var pet Pet
-	reqToken := r.Header.Get("Authorization")
-	splitToken := strings.Split(reqToken, "Bearer ")
-	reqToken = splitToken[1]
-	token, err := extractTokenFromJWT(reqToken)
+// GetPetQRCode answers the pet with its QR code as a base64 PNG, only rendered here
+func GetPetQRCode(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	encoded, err := GenerateBase64(pet.QRCode.Url)
 	if err != nil {
+		LogErr(r, err)
 		response := HTTPResponse{
-			Error:  err.Error(),
-			Status: http.StatusBadRequest,
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
 		}
 		RespondJson(w, r, response)
 		return
 	}
-	userToken, _ := readJWTClaims(token)
-
-	db.Preload("QRCode").Where("user_id = ?", userToken.id).Where("slug = ?", petSlug).Find(&pet)
+	pet.QRCode.Base64 = encoded
 
 	response := HTTPResponse{
 		Data:   pet,
@@ -55,3 +274,64 @@ func GetPetQRCode(w http.ResponseWriter, r *http.Request) {
 
 	RespondJson(w, r, response)
 }
+
+// respondQRCode renders the QR code of the URL in the given format with caching headers
+func respondQRCode(w http.ResponseWriter, r *http.Request, url string, format string) {
+	options, errors := parseQROptions(r.URL.Query())
+	if len(errors) > 0 {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	// Same content and options always render the same file
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%v", url, format, options))))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var body []byte
+	var err error
+	var contentType string
+	if format == "svg" {
+		body, err = renderQRCodeSVG(url, options)
+		contentType = "image/svg+xml"
+	} else {
+		body, err = renderQRCodePNG(url, options)
+		contentType = "image/png"
+	}
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if _, err := w.Write(body); err != nil {
+		LogErr(r, err)
+	}
+}
+
+func GetPetQRCodePNG(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	respondQRCode(w, r, pet.QRCode.Url, "png")
+}
+
+func GetPetQRCodeSVG(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	respondQRCode(w, r, pet.QRCode.Url, "svg")
+}
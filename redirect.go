@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultRebuildBatchSize = 500
+
+// QRCodeRedirect remembers an URL once printed on a tag so that it keeps leading to the pet
+type QRCodeRedirect struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	OldURL    string    `gorm:"uniqueIndex" json:"old_url"`
+	QRCodeID  uint      `gorm:"index" json:"qr_code_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// stableTagURL is printed on the tags when QR_BASE_URL is set: the backend
+// redirects it to the frontend of the moment, so domain changes don't break printed tags
+func stableTagURL(base string, token string) string {
+	return fmt.Sprintf("%s/r/%s", strings.TrimSuffix(base, "/"), token)
+}
+
+// publicPetURL is the frontend page of a tag
+func publicPetURL(token string) string {
+	return fmt.Sprintf("%s/pet/%s", os.Getenv("FRONTEND_URL"), token)
+}
+
+// rebuildQRCodeURLs points every tag to the given base URL, in batches. Previous
+// URLs are kept as redirects. QR images are rendered from the URL on demand.
+func rebuildQRCodeURLs(base string, batchSize int, dryRun bool) (int, error) {
+	updated := 0
+	var tags []QRCode
+	result := db.Unscoped().FindInBatches(&tags, batchSize, func(tx *gorm.DB, batch int) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			for _, tag := range tags {
+				url := stableTagURL(base, tag.Token)
+				if tag.Url == url {
+					continue
+				}
+
+				updated++
+				if dryRun {
+					continue
+				}
+
+				redirect := QRCodeRedirect{OldURL: tag.Url, QRCodeID: tag.ID}
+				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&redirect).Error; err != nil {
+					return err
+				}
+				if err := tx.Unscoped().Model(&QRCode{}).Where("id = ?", tag.ID).Update("url", url).Error; err != nil {
+					return err
+				}
+			}
+
+			log.Info().Int("Batch", batch).Int("Updated", updated).Msg("QR code URLs rebuilt")
+			return nil
+		})
+	})
+
+	return updated, result.Error
+}
+
+// runCommand runs a maintenance command given on the command line and returns the exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "rebuild-qr-urls":
+		flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+		base := flags.String("base", os.Getenv("QR_BASE_URL"), "base URL printed on the tags, defaults to QR_BASE_URL")
+		batchSize := flags.Int("batch", defaultRebuildBatchSize, "tags updated per transaction")
+		dryRun := flags.Bool("dry-run", false, "count the tags to update without changing them")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *base == "" || *batchSize < 1 {
+			fmt.Println("Usage: rebuild-qr-urls -base https://api.example.org [-batch 500] [-dry-run]")
+			return 2
+		}
+
+		updated, err := rebuildQRCodeURLs(*base, *batchSize, *dryRun)
+		if err != nil {
+			log.Error().Msg(err.Error())
+			return 1
+		}
+		fmt.Printf("%d QR code(s) to %s\n", updated, *base)
+		return 0
+	default:
+		fmt.Printf("Unknown command %s, available commands: rebuild-qr-urls\n", args[0])
+		return 2
+	}
+}
+
+// RedirectTag sends a scanned tag to the current frontend, keeping the query string
+func RedirectTag(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	var tag QRCode
+	if err := db.Where("token = ?", token).First(&tag).Error; err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "token",
+					Error: "QR code introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	target := publicPetURL(tag.Token)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+
+	// Not permanent: the frontend may move again
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// legacyRedirectMiddleware serves the redirect map: a browser opening an URL printed
+// before a rebuild, on a domain now pointing to the backend, is sent to the tag's current page
+func legacyRedirectMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+
+		var redirect QRCodeRedirect
+		err := db.Where("old_url = ?", fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.Path)).First(&redirect).Error
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var tag QRCode
+		if err := db.First(&tag, redirect.QRCodeID).Error; err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Redirect(w, r, publicPetURL(tag.Token), http.StatusMovedPermanently)
+	})
+}
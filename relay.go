@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	ConversationStatusOpen   = "open"
+	ConversationStatusClosed = "closed"
+)
+
+const (
+	RelaySenderOwner  = "owner"
+	RelaySenderFinder = "finder"
+)
+
+const (
+	maxRelayMessage = 1000
+	// A conversation expires once nobody wrote for this long
+	relayTTL = 30 * 24 * time.Hour
+)
+
+// Conversation relays messages between a finder and an owner who don't know each other's contact details
+type Conversation struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	ReportID     uint       `gorm:"uniqueIndex" json:"report_id"`
+	Token        string     `gorm:"type:varchar(64);uniqueIndex" json:"-"`
+	FinderEmail  string     `gorm:"type:varchar(50)" json:"-"`
+	Status       string     `gorm:"type:varchar(10);default:'open'" json:"status"`
+	OwnerShared  bool       `json:"owner_shared"`
+	FinderShared bool       `json:"finder_shared"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	ClosedAt     *time.Time `json:"closed_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+type RelayMessage struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	ConversationID uint      `gorm:"index" json:"-"`
+	Sender         string    `gorm:"type:varchar(10)" json:"sender"`
+	Body           string    `gorm:"type:varchar(1000)" json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type RelayMessageRequest struct {
+	Body string `json:"body"`
+}
+
+func (rmr *RelayMessageRequest) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	length := utf8.RuneCountInString(strings.TrimSpace(rmr.Body))
+	if length == 0 || length > maxRelayMessage {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "body",
+			Error: fmt.Sprintf("Le message doit compter entre 1 et %d caractères", maxRelayMessage),
+		})
+	}
+
+	return fieldErr
+}
+
+// RelayContact is shown to the other side only once shared
+type RelayContact struct {
+	Name  string `json:"name,omitempty"`
+	Phone string `json:"phone,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// ConversationView is a conversation as seen by one of its sides
+type ConversationView struct {
+	Conversation
+	Open     bool           `json:"open"`
+	PetName  string         `json:"pet_name"`
+	Messages []RelayMessage `json:"messages"`
+	Contact  *RelayContact  `json:"contact,omitempty"`
+}
+
+func (c *Conversation) IsOpen() bool {
+	return c.Status == ConversationStatusOpen && time.Now().Before(c.ExpiresAt)
+}
+
+func relayURL(token string) string {
+	return fmt.Sprintf("%s/relay/%s", os.Getenv("FRONTEND_URL"), token)
+}
+
+// openConversation starts the relay of a new report, the token being the finder's only key
+func openConversation(tx *gorm.DB, report *Report, finderEmail string) (Conversation, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Conversation{}, err
+	}
+
+	conversation := Conversation{
+		ReportID:    report.ID,
+		Token:       hex.EncodeToString(secret),
+		FinderEmail: finderEmail,
+		Status:      ConversationStatusOpen,
+		ExpiresAt:   time.Now().Add(relayTTL),
+	}
+
+	return conversation, tx.Create(&conversation).Error
+}
+
+// relayParties loads the report and the pet of a conversation
+func relayParties(conversation *Conversation) (*Report, *Pet, error) {
+	var report Report
+	if err := db.First(&report, conversation.ReportID).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var pet Pet
+	if err := db.Preload("User").First(&pet, report.PetID).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return &report, &pet, nil
+}
+
+func viewConversation(conversation *Conversation, report *Report, pet *Pet, side string) ConversationView {
+	view := ConversationView{
+		Conversation: *conversation,
+		Open:         conversation.IsOpen(),
+		PetName:      pet.ToPublic().Name,
+		Messages:     []RelayMessage{},
+	}
+	db.Where("conversation_id = ?", conversation.ID).Order("created_at").Order("id").Find(&view.Messages)
+
+	if side == RelaySenderOwner {
+		view.PetName = pet.Name
+		if conversation.FinderShared {
+			view.Contact = &RelayContact{Phone: report.PhoneNumber, Email: conversation.FinderEmail}
+		}
+	} else if conversation.OwnerShared {
+		view.Contact = &RelayContact{Name: pet.User.Firstname, Phone: pet.User.Phone, Email: pet.User.Email}
+	}
+
+	return view
+}
+
+// notifyRelayMessage warns the other side, the finder only when an email was left
+func notifyRelayMessage(r *http.Request, conversation *Conversation, report *Report, pet *Pet, message RelayMessage) {
+	if message.Sender == RelaySenderFinder {
+		notification, err := newReportNotification(pet, report)
+		if err != nil {
+			LogErr(r, err)
+			return
+		}
+		notification.Event = NotificationEventRelayMessage
+		notification.Message = &MessageNotification{
+			Sender:    message.Sender,
+			Body:      message.Body,
+			CreatedAt: message.CreatedAt,
+			ReplyURL:  fmt.Sprintf("%s/reports/%d", os.Getenv("FRONTEND_URL"), report.ID),
+		}
+		sendNotification(r, notification)
+		return
+	}
+
+	if conversation.FinderEmail == "" {
+		return
+	}
+
+	// Nothing about the owner goes to the finder, only the message
+	sendNotification(r, ReportNotification{
+		Event:       NotificationEventRelayMessage,
+		Recipient:   User{Email: conversation.FinderEmail},
+		Preferences: NotificationPreference{Email: true},
+		PetName:     pet.ToPublic().Name,
+		Report:      ReportResponse{ID: report.ID},
+		Message: &MessageNotification{
+			Sender:    message.Sender,
+			Body:      message.Body,
+			CreatedAt: message.CreatedAt,
+			ReplyURL:  relayURL(conversation.Token),
+		},
+	})
+}
+
+// finderConversation finds the conversation of the {token} route variable
+func finderConversation(r *http.Request) (*Conversation, int, FieldErrors) {
+	var conversation Conversation
+	if err := db.Where("token = ?", mux.Vars(r)["token"]).First(&conversation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, http.StatusNotFound, FieldErrors{{Field: "token", Error: "Conversation introuvable"}}
+		}
+		return nil, http.StatusBadRequest, FieldErrors{{Field: "-", Error: err.Error()}}
+	}
+
+	return &conversation, http.StatusOK, nil
+}
+
+// ownerConversation finds the conversation of the user's report of the {id} route variable
+func ownerConversation(r *http.Request) (*Conversation, int, FieldErrors) {
+	report, status, errors := userReport(r)
+	if errors != nil {
+		return nil, status, errors
+	}
+
+	var conversation Conversation
+	if err := db.Where("report_id = ?", report.ID).First(&conversation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, http.StatusNotFound, FieldErrors{{Field: "id", Error: "Ce signalement n'a pas de conversation"}}
+		}
+		return nil, http.StatusBadRequest, FieldErrors{{Field: "-", Error: err.Error()}}
+	}
+
+	return &conversation, http.StatusOK, nil
+}
+
+type conversationLoader func(r *http.Request) (*Conversation, int, FieldErrors)
+
+// relayHandler resolves the conversation and its parties for the given side before calling the handler
+func relayHandler(load conversationLoader, side string, handler func(w http.ResponseWriter, r *http.Request, conversation *Conversation, report *Report, pet *Pet, side string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversation, status, errors := load(r)
+		if errors != nil {
+			response := HTTPResponse{
+				Error:  errors,
+				Status: status,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+
+		report, pet, err := relayParties(conversation)
+		if err != nil {
+			response := HTTPResponse{
+				Error: FieldErrors{
+					{
+						Field: "-",
+						Error: "Conversation introuvable",
+					},
+				},
+				Status: http.StatusNotFound,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+
+		handler(w, r, conversation, report, pet, side)
+	}
+}
+
+func GetConversation(w http.ResponseWriter, r *http.Request, conversation *Conversation, report *Report, pet *Pet, side string) {
+	response := HTTPResponse{
+		Data:   viewConversation(conversation, report, pet, side),
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func PostConversationMessage(w http.ResponseWriter, r *http.Request, conversation *Conversation, report *Report, pet *Pet, side string) {
+	if !conversation.IsOpen() {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "status",
+					Error: "Cette conversation est terminée",
+				},
+			},
+			Status: http.StatusGone,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var messageRequest RelayMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&messageRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if errors := messageRequest.Validate(); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   messageRequest,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	message := RelayMessage{
+		ConversationID: conversation.ID,
+		Sender:         side,
+		Body:           strings.TrimSpace(messageRequest.Body),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&message).Error; err != nil {
+			return err
+		}
+
+		conversation.ExpiresAt = time.Now().Add(relayTTL)
+		return tx.Model(conversation).Update("expires_at", conversation.ExpiresAt).Error
+	})
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	notifyRelayMessage(r, conversation, report, pet, message)
+
+	response := HTTPResponse{
+		Data:   message,
+		Error:  nil,
+		Status: http.StatusCreated,
+	}
+	RespondJson(w, r, response)
+}
+
+// ShareConversationContact reveals the caller's contact details to the other side
+func ShareConversationContact(w http.ResponseWriter, r *http.Request, conversation *Conversation, report *Report, pet *Pet, side string) {
+	column := "finder_shared"
+	if side == RelaySenderOwner {
+		column = "owner_shared"
+		conversation.OwnerShared = true
+	} else {
+		conversation.FinderShared = true
+	}
+
+	if err := db.Model(conversation).Update(column, true).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	GetConversation(w, r, conversation, report, pet, side)
+}
+
+func CloseConversation(w http.ResponseWriter, r *http.Request, conversation *Conversation, report *Report, pet *Pet, side string) {
+	if conversation.Status != ConversationStatusClosed {
+		now := time.Now()
+		conversation.Status = ConversationStatusClosed
+		conversation.ClosedAt = &now
+		err := db.Model(conversation).Updates(map[string]interface{}{
+			"status":    conversation.Status,
+			"closed_at": conversation.ClosedAt,
+		}).Error
+		if err != nil {
+			LogErr(r, err)
+			response := HTTPResponse{
+				Error: FieldErrors{
+					FieldError{
+						Field: "-",
+						Error: err.Error(),
+					},
+				},
+				Status: http.StatusUnprocessableEntity,
+			}
+			RespondJson(w, r, response)
+			return
+		}
+	}
+
+	GetConversation(w, r, conversation, report, pet, side)
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"mime/multipart"
 	"net/http"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type Report struct {
@@ -18,35 +21,194 @@ type Report struct {
 	HasPet      bool   `gorm:"type:boolean" json:"has_pet"`
 	Additional  string `gorm:"type:varchar(255)" json:"additional"`
 
-	PetID uint `gorm:"type:integer" json:"pet_id"`
+	// Position shared by the finder's device, accuracy in meters
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Accuracy  *float64 `json:"accuracy"`
+
+	Status    string `gorm:"type:varchar(10);default:'new';index" json:"status"`
+	OwnerNote string `gorm:"type:varchar(500)" json:"owner_note"`
+
+	PetID  uint          `gorm:"type:integer;index" json:"pet_id"`
+	Photos []ReportPhoto `gorm:"foreignKey:ReportID" json:"-"`
+
+	// Finders who don't want to share their phone talk to the owner through a relay
+	UseRelay   bool   `gorm:"-" json:"use_relay"`
+	RelayEmail string `gorm:"-" json:"relay_email,omitempty"`
+	RelayURL   string `gorm:"-" json:"relay_url,omitempty"`
+
+	// Website is a honeypot hidden to humans, Proof answers the challenge of the report verifier
+	Website     string `gorm:"-" json:"website,omitempty"`
+	Nonce       string `gorm:"-" json:"nonce,omitempty"`
+	Proof       string `gorm:"-" json:"proof,omitempty"`
+	Fingerprint string `gorm:"type:varchar(64);index" json:"-"`
+
+	CreatedAt  time.Time  `gorm:"default:CURRENT_TIMESTAMP" json:"created_at"`
+	ReadAt     *time.Time `json:"read_at"`
+	ArchivedAt *time.Time `json:"archived_at"`
 }
 
 type ReportResponse struct {
-	ID          uint   `json:"id"`
-	PhoneNumber string `json:"phone_number"`
-	City        string `json:"city"`
-	Where       string `json:"where"`
-	HasPet      bool   `json:"has_pet"`
-	Additional  string `json:"additional"`
+	ID          uint       `json:"id"`
+	PetID       uint       `json:"pet_id"`
+	PhoneNumber string     `json:"phone_number"`
+	City        string     `json:"city"`
+	Where       string     `json:"where"`
+	HasPet      bool       `json:"has_pet"`
+	Additional  string     `json:"additional"`
+	Latitude    *float64   `json:"latitude"`
+	Longitude   *float64   `json:"longitude"`
+	Accuracy    *float64   `json:"accuracy"`
+	Status      string     `json:"status"`
+	OwnerNote   string     `json:"owner_note"`
+	Fingerprint string     `json:"fingerprint"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Read        bool       `json:"read"`
+	Archived    bool       `json:"archived"`
+	ReadAt      *time.Time `json:"read_at"`
+	ArchivedAt  *time.Time `json:"archived_at"`
+
+	Photos []ReportPhotoResponse `json:"photos"`
 }
 
+// ToResponse signs links to the photos, which must be preloaded
 func (r *Report) ToResponse() ReportResponse {
+	photos := []ReportPhotoResponse{}
+	for _, photo := range r.Photos {
+		photos = append(photos, photo.ToResponse())
+	}
+
 	return ReportResponse{
 		ID:          r.ID,
+		PetID:       r.PetID,
 		PhoneNumber: r.PhoneNumber,
 		City:        r.City,
 		Where:       r.Where,
 		HasPet:      r.HasPet,
 		Additional:  r.Additional,
+		Latitude:    r.Latitude,
+		Longitude:   r.Longitude,
+		Accuracy:    r.Accuracy,
+		Status:      r.Status,
+		OwnerNote:   r.OwnerNote,
+		Fingerprint: r.Fingerprint,
+		CreatedAt:   r.CreatedAt,
+		Read:        r.ReadAt != nil,
+		Archived:    r.ArchivedAt != nil,
+		ReadAt:      r.ReadAt,
+		ArchivedAt:  r.ArchivedAt,
+		Photos:      photos,
 	}
 }
 
+// resetServerFields drops what finders may send but only the server sets
+func (r *Report) resetServerFields() {
+	r.ID = 0
+	r.PetID = 0
+	r.CreatedAt = time.Time{}
+	r.ReadAt = nil
+	r.ArchivedAt = nil
+	r.Status = ReportStatusNew
+	r.OwnerNote = ""
+	r.RelayURL = ""
+	r.Fingerprint = ""
+	r.Photos = nil
+}
+
+// Validate also trims the report and normalizes the phone number to E.164
+func (r *Report) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	r.City = strings.TrimSpace(r.City)
+	r.Where = strings.TrimSpace(r.Where)
+	r.Additional = strings.TrimSpace(r.Additional)
+	r.RelayEmail = strings.TrimSpace(r.RelayEmail)
+
+	// Phone is optional but must be a valid number
+	if strings.TrimSpace(r.PhoneNumber) != "" {
+		phone, err := normalizePhone(r.PhoneNumber)
+		if err != nil {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "phone_number",
+				Error: err.Error(),
+			})
+		} else {
+			r.PhoneNumber = phone
+		}
+	} else {
+		r.PhoneNumber = ""
+	}
+
+	// Relay email is optional but must look like an address
+	if r.RelayEmail != "" {
+		email, err := normalizeEmail(r.RelayEmail)
+		if err != nil {
+			fieldErr = append(fieldErr, FieldError{
+				Field: "relay_email",
+				Error: err.Error(),
+			})
+		} else {
+			r.RelayEmail = email
+		}
+	}
+
+	// An email is only ever reached through the relay
+	if r.RelayEmail != "" {
+		r.UseRelay = true
+	}
+
+	// The owner needs a way to reach the finder
+	if r.PhoneNumber == "" && r.RelayEmail == "" && !r.UseRelay {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "phone_number",
+			Error: "Indiquez un numéro de téléphone, une adresse email ou utilisez la messagerie anonyme",
+		})
+	}
+
+	if utf8.RuneCountInString(r.City) > 50 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "city",
+			Error: "La ville ne doit pas dépasser 50 caractères",
+		})
+	}
+
+	if utf8.RuneCountInString(r.Where) > 50 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "where",
+			Error: "Le lieu ne doit pas dépasser 50 caractères",
+		})
+	}
+
+	if utf8.RuneCountInString(r.Additional) > 255 {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "additional",
+			Error: "Les informations complémentaires ne doivent pas dépasser 255 caractères",
+		})
+	}
+
+	fieldErr = append(fieldErr, validateCoordinates(r.Latitude, r.Longitude, r.Accuracy)...)
+
+	return fieldErr
+}
+
+// decodeReport reads a JSON report, or a multipart form with the JSON in the report field and images in photos
+func decodeReport(w http.ResponseWriter, r *http.Request) (Report, []*multipart.FileHeader, error) {
+	var report Report
+	files, err := decodeWithPhotos(w, r, "report", &report)
+	return report, files, err
+}
+
 func CreateReport(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	petSlug := params["slug"]
-	var report Report
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&report); err != nil {
+	fingerprint := reporterFingerprint(r)
+	if ok, retryAfter := reportIPLimiter.Allow(fingerprint); !ok {
+		respondTooManyRequests(w, r, retryAfter)
+		return
+	}
+
+	report, files, err := decodeReport(w, r)
+	if err != nil {
 		response := HTTPResponse{
 			Error:  err.Error(),
 			Status: http.StatusBadRequest,
@@ -55,9 +217,32 @@ func CreateReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reqToken := r.Header.Get("Authorization")
-	splitToken := strings.Split(reqToken, "Bearer ")
-	reqToken = splitToken[1]
+	// Bots fill every field, pretend it worked so they don't adapt
+	if report.Website != "" {
+		LogDebug(r, "Honeypot filled, report dropped")
+		response := HTTPResponse{
+			Data:   Report{},
+			Error:  nil,
+			Status: http.StatusCreated,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	report.resetServerFields()
+	report.Fingerprint = fingerprint
+	errors := report.Validate()
+	if len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   report,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	reqToken := bearerToken(r)
 	if reqToken == "" {
 		response := HTTPResponse{
 			Error: FieldErrors{
@@ -72,7 +257,6 @@ func CreateReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info().Msg(reqToken)
 	token, err := extractTokenFromJWT(reqToken)
 	if err != nil {
 		response := HTTPResponse{
@@ -82,18 +266,15 @@ func CreateReport(w http.ResponseWriter, r *http.Request) {
 					Error: err.Error(),
 				},
 			},
-			Status: http.StatusBadRequest,
+			Status: http.StatusUnauthorized,
 		}
 		RespondJson(w, r, response)
 		return
 	}
 
-	claims, _ := readReportJWTClaims(token)
-
-	var pet Pet
-	db.Find(&pet, claims.id)
-
-	if pet.Slug != petSlug {
+	if _, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		log.Info().Msg("JWT is valid")
+	} else {
 		response := HTTPResponse{
 			Error: FieldErrors{
 				{
@@ -107,11 +288,46 @@ func CreateReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info().Msg(fmt.Sprintf("%v", claims.id))
-	log.Info().Msg("JWT claims : " + fmt.Sprintf("%d", 10))
-	if _, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		log.Info().Msg("JWT is valid")
-	} else {
+	if err := reportVerifier.Verify(report.Nonce, report.Proof); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "proof",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusForbidden,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	claims, err := readReportJWTClaims(token)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	_, pet, status, errors := resolvePublicTag(petSlug)
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if pet.ID != uint(claims.id) {
 		response := HTTPResponse{
 			Error: FieldErrors{
 				{
@@ -125,12 +341,81 @@ func CreateReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if ok, retryAfter := reportPetLimiter.Allow(fmt.Sprintf("%d", pet.ID)); !ok {
+		respondTooManyRequests(w, r, retryAfter)
+		return
+	}
+
+	if isBlockedReporter(fingerprint, pet.UserID) {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "-",
+					Error: "Vous ne pouvez plus signaler cet animal",
+				},
+			},
+			Status: http.StatusForbidden,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	// Decoding images is the expensive part, it only happens once every check passed
+	photos, photoErrors := processReportPhotos(files)
+	if len(photoErrors) > 0 {
+		response := HTTPResponse{
+			Data:   report,
+			Error:  photoErrors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
 	log.Info().
 		Str("RequestID", r.Context().Value("requestID").(string)).
 		Msg("Report received !")
 
 	report.PetID = pet.ID
-	if err := db.Create(&report).Error; err != nil {
+	// Spam is kept for the owner to review, but nobody is notified
+	if looksLikeSpam(&report) {
+		report.Status = ReportStatusSpam
+	}
+
+	var stored []ReportPhoto
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&report).Error; err != nil {
+			return err
+		}
+
+		if report.UseRelay {
+			conversation, err := openConversation(tx, &report, report.RelayEmail)
+			if err != nil {
+				return err
+			}
+			report.RelayURL = relayURL(conversation.Token)
+		}
+
+		for _, photo := range photos {
+			reportPhoto, err := storeReportPhoto(report.ID, photo)
+			stored = append(stored, reportPhoto)
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&reportPhoto).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		for _, reportPhoto := range stored {
+			if err := storage.Delete(reportPhoto.Key); err != nil {
+				LogErr(r, err)
+			}
+		}
+
 		response := HTTPResponse{
 			Error:  err.Error(),
 			Status: http.StatusBadRequest,
@@ -139,6 +424,21 @@ func CreateReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	report.Photos = stored
+
+	if err := storeReportLocation(&report); err != nil {
+		LogErr(r, err)
+	}
+
+	if report.Status != ReportStatusSpam {
+		notification, err := newReportNotification(pet, &report)
+		if err != nil {
+			LogErr(r, err)
+		} else {
+			notifyOwner(r, notification)
+		}
+	}
+
 	response := HTTPResponse{
 		Data:   report,
 		Error:  nil,
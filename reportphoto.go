@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxReportPhotos    = 3
+	maxReportPhotoSize = 5 << 20
+	// Refuse images whose decoded pixels would not fit in a reasonable amount of memory,
+	// 16 MP being 64 MB once decoded, twice that when the orientation is applied
+	maxReportPhotoPixels = 16_000_000
+	reportPhotoURLTTL    = 15 * time.Minute
+)
+
+// ReportPhoto is an image sent by a finder with a report or a found report, the file itself lives in the storage
+type ReportPhoto struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	ReportID      uint      `gorm:"index" json:"report_id"`
+	FoundReportID uint      `gorm:"index" json:"found_report_id"`
+	Key           string    `gorm:"type:varchar(100)" json:"-"`
+	ContentType   string    `gorm:"type:varchar(20)" json:"content_type"`
+	Size          int       `json:"size"`
+	Width         int       `json:"width"`
+	Height        int       `json:"height"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ReportPhotoResponse gives the owner a temporary link to a photo
+type ReportPhotoResponse struct {
+	ID        uint      `json:"id"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+}
+
+// processedPhoto is an upload re-encoded without its metadata, ready to be stored
+type processedPhoto struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+func reportPhotoSecret() []byte {
+	if secret := os.Getenv("STORAGE_URL_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+
+	return getJWTSecret()
+}
+
+func signReportPhoto(id uint, expires int64) string {
+	mac := hmac.New(sha256.New, reportPhotoSecret())
+	fmt.Fprintf(mac, "report-photo|%d|%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *ReportPhoto) ToResponse() ReportPhotoResponse {
+	expiresAt := time.Now().Add(reportPhotoURLTTL).Truncate(time.Second)
+	expires := expiresAt.Unix()
+
+	return ReportPhotoResponse{
+		ID:        p.ID,
+		URL:       fmt.Sprintf("/report-photos/%d?expires=%d&signature=%s", p.ID, expires, signReportPhoto(p.ID, expires)),
+		ExpiresAt: expiresAt,
+		Width:     p.Width,
+		Height:    p.Height,
+	}
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, 1 when there is none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			return 1
+		}
+
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 14 && string(segment[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for e := 0; e < entries; e++ {
+		entry := offset + 2 + e*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+
+	return 1
+}
+
+// applyOrientation turns the pixels the way the EXIF orientation asked viewers to
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if orientation >= 5 {
+		w, h = h, w
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = w-1-y, x
+			case 7:
+				dx, dy = w-1-y, h-1-x
+			case 8:
+				dx, dy = y, h-1-x
+			}
+			out.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return out
+}
+
+// processReportPhoto checks an upload and re-encodes it, which drops EXIF and any other metadata
+func processReportPhoto(file *multipart.FileHeader) (processedPhoto, error) {
+	if file.Size > maxReportPhotoSize {
+		return processedPhoto{}, fmt.Errorf("%s dépasse %d Mo", file.Filename, maxReportPhotoSize>>20)
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return processedPhoto{}, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxReportPhotoSize+1))
+	if err != nil {
+		return processedPhoto{}, err
+	}
+	if len(data) > maxReportPhotoSize {
+		return processedPhoto{}, fmt.Errorf("%s dépasse %d Mo", file.Filename, maxReportPhotoSize>>20)
+	}
+
+	contentType := http.DetectContentType(data)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return processedPhoto{}, fmt.Errorf("%s doit être une image JPEG ou PNG", file.Filename)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return processedPhoto{}, fmt.Errorf("%s n'est pas une image lisible", file.Filename)
+	}
+	if config.Width*config.Height > maxReportPhotoPixels {
+		return processedPhoto{}, fmt.Errorf("%s dépasse %d mégapixels", file.Filename, maxReportPhotoPixels/1_000_000)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return processedPhoto{}, fmt.Errorf("%s n'est pas une image lisible", file.Filename)
+	}
+
+	var out bytes.Buffer
+	if contentType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&out, img)
+	}
+	if err != nil {
+		return processedPhoto{}, err
+	}
+
+	return processedPhoto{
+		Data:        out.Bytes(),
+		ContentType: contentType,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}, nil
+}
+
+// decodeWithPhotos reads a JSON body into v, or a multipart form with the JSON in the field and images in photos
+func decodeWithPhotos(w http.ResponseWriter, r *http.Request, field string, v interface{}) ([]*multipart.FileHeader, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return nil, json.NewDecoder(r.Body).Decode(v)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxReportPhotos*maxReportPhotoSize+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(r.FormValue(field)), v); err != nil {
+		return nil, err
+	}
+
+	return r.MultipartForm.File["photos"], nil
+}
+
+// processReportPhotos checks and re-encodes every upload, reporting each bad file
+func processReportPhotos(files []*multipart.FileHeader) ([]processedPhoto, FieldErrors) {
+	if len(files) > maxReportPhotos {
+		return nil, FieldErrors{{
+			Field: "photos",
+			Error: fmt.Sprintf("Vous pouvez joindre au plus %d photos", maxReportPhotos),
+		}}
+	}
+
+	var photos []processedPhoto
+	var photoErrors FieldErrors
+	for _, file := range files {
+		photo, err := processReportPhoto(file)
+		if err != nil {
+			photoErrors = append(photoErrors, FieldError{Field: "photos", Error: err.Error()})
+			continue
+		}
+		photos = append(photos, photo)
+	}
+
+	return photos, photoErrors
+}
+
+// storePhoto saves a processed photo under the directory, the caller removing the file if the transaction fails
+func storePhoto(directory string, photo processedPhoto) (ReportPhoto, error) {
+	extension := "jpg"
+	if photo.ContentType == "image/png" {
+		extension = "png"
+	}
+
+	reportPhoto := ReportPhoto{
+		Key:         fmt.Sprintf("%s/%s.%s", directory, uuid.New().String(), extension),
+		ContentType: photo.ContentType,
+		Size:        len(photo.Data),
+		Width:       photo.Width,
+		Height:      photo.Height,
+	}
+
+	return reportPhoto, storage.Put(reportPhoto.Key, photo.Data)
+}
+
+// storeReportPhoto saves a processed photo of the report
+func storeReportPhoto(reportID uint, photo processedPhoto) (ReportPhoto, error) {
+	reportPhoto, err := storePhoto(fmt.Sprintf("reports/%d", reportID), photo)
+	reportPhoto.ReportID = reportID
+	return reportPhoto, err
+}
+
+// storeFoundPhoto saves a processed photo of the found report
+func storeFoundPhoto(foundID uint, photo processedPhoto) (ReportPhoto, error) {
+	reportPhoto, err := storePhoto(fmt.Sprintf("found/%d", foundID), photo)
+	reportPhoto.FoundReportID = foundID
+	return reportPhoto, err
+}
+
+// GetReportPhoto serves a photo to whoever holds a valid signed link
+func GetReportPhoto(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	expires, expiresErr := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || expiresErr != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(signReportPhoto(uint(id), expires)), []byte(query.Get("signature"))) {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "signature",
+					Error: "Lien invalide ou expiré",
+				},
+			},
+			Status: http.StatusForbidden,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var photo ReportPhoto
+	if err := db.First(&photo, id).Error; err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Photo introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	data, err := storage.Get(photo.Key)
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "Photo introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	w.Header().Set("Content-Type", photo.ContentType)
+	w.Header().Set("Cache-Control", "private, max-age=900")
+	if _, err := w.Write(data); err != nil {
+		LogErr(r, err)
+	}
+}
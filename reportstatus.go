@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"time"
+)
+
+const (
+	ReportStatusNew       = "new"
+	ReportStatusContacted = "contacted"
+	ReportStatusResolved  = "resolved"
+	ReportStatusReunited  = "reunited"
+	ReportStatusSpam      = "spam"
+)
+
+const maxReportNote = 500
+
+// reportTransitions lists the statuses a report may move to from each status.
+// Resolved and spam reports can be reopened, a reunion is final.
+var reportTransitions = map[string][]string{
+	ReportStatusNew:       {ReportStatusContacted, ReportStatusResolved, ReportStatusReunited, ReportStatusSpam},
+	ReportStatusContacted: {ReportStatusResolved, ReportStatusReunited, ReportStatusSpam},
+	ReportStatusResolved:  {ReportStatusNew},
+	ReportStatusSpam:      {ReportStatusNew},
+	ReportStatusReunited:  {},
+}
+
+// ReportStatusEvent records each transition of a report
+type ReportStatusEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	ReportID  uint      `gorm:"index" json:"report_id"`
+	From      string    `gorm:"type:varchar(10)" json:"from"`
+	To        string    `gorm:"type:varchar(10)" json:"to"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ReportStatusRequest struct {
+	Status string  `json:"status"`
+	Note   *string `json:"note"`
+}
+
+func (rsr *ReportStatusRequest) Validate(current string) FieldErrors {
+	var fieldErr FieldErrors
+
+	if _, ok := reportTransitions[rsr.Status]; !ok {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "status",
+			Error: "Le statut doit être new, contacted, resolved, reunited ou spam",
+		})
+	} else if rsr.Status != current && !canMoveReport(current, rsr.Status) {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "status",
+			Error: fmt.Sprintf("Un signalement %s ne peut pas passer en %s", current, rsr.Status),
+		})
+	}
+
+	if rsr.Note != nil && len(*rsr.Note) > maxReportNote {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "note",
+			Error: fmt.Sprintf("La note ne doit pas dépasser %d caractères", maxReportNote),
+		})
+	}
+
+	return fieldErr
+}
+
+func canMoveReport(from, to string) bool {
+	for _, allowed := range reportTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// changeReportStatus saves the report and its transition. A reunion brings the pet back home.
+func changeReportStatus(tx *gorm.DB, report *Report, status string) error {
+	if report.Status == status {
+		return tx.Omit(clause.Associations).Save(report).Error
+	}
+
+	event := ReportStatusEvent{
+		ReportID: report.ID,
+		From:     report.Status,
+		To:       status,
+	}
+
+	report.Status = status
+	if err := tx.Omit(clause.Associations).Save(report).Error; err != nil {
+		return err
+	}
+	if err := tx.Create(&event).Error; err != nil {
+		return err
+	}
+
+	if status != ReportStatusReunited {
+		return nil
+	}
+
+	var pet Pet
+	if err := tx.First(&pet, report.PetID).Error; err != nil {
+		return err
+	}
+	if !pet.IsLost() {
+		return nil
+	}
+
+	return changePetStatus(tx, &pet, PetStatusHome)
+}
+
+func UpdateReportStatus(w http.ResponseWriter, r *http.Request) {
+	report, status, errors := userReport(r)
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var statusRequest ReportStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&statusRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if errors := statusRequest.Validate(report.Status); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   statusRequest,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if statusRequest.Note != nil {
+		report.OwnerNote = *statusRequest.Note
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return changeReportStatus(tx, report, statusRequest.Status)
+	})
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   report.ToResponse(),
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func GetReportStatusHistory(w http.ResponseWriter, r *http.Request) {
+	report, status, errors := userReport(r)
+	if errors != nil {
+		response := HTTPResponse{
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var events []ReportStatusEvent
+	db.Where("report_id = ?", report.ID).Order("created_at desc").Find(&events)
+
+	response := HTTPResponse{
+		Data:   events,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
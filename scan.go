@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxScanHistory = 200
+
+const (
+	ScanSourceQR   = "qr"
+	ScanSourceNFC  = "nfc"
+	ScanSourceCode = "code"
+)
+
+// ScanEvent is one visit of the public page of a pet through one of its tags
+type ScanEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	PetID     uint      `gorm:"index" json:"pet_id"`
+	TagID     uint      `json:"tag_id"`
+	Source    string    `gorm:"type:varchar(10);default:'qr';index" json:"source"`
+	UserAgent string    `gorm:"type:varchar(40)" json:"user_agent"`
+	Latitude  *float64  `json:"latitude"`
+	Longitude *float64  `json:"longitude"`
+	IPHash    string    `gorm:"type:varchar(64);index" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// trustedProxies are the networks of the reverse proxies allowed to set X-Forwarded-For
+var trustedProxies []*net.IPNet
+
+// loadTrustedProxies reads TRUSTED_PROXIES, a comma separated list of addresses or CIDR networks
+func loadTrustedProxies() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			networks = append(networks, network)
+		} else {
+			log.Error().Str("Proxy", entry).Msg("Ignoring invalid trusted proxy")
+		}
+	}
+
+	return networks
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP is the remote address, unless it is a trusted proxy: X-Forwarded-For is then read
+// from the right, the first address not belonging to a trusted proxy being the client's
+func clientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote = host
+	}
+
+	ip := net.ParseIP(remote)
+	if ip == nil || !isTrustedProxy(ip) {
+		return remote
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		if !isTrustedProxy(hop) {
+			return hop.String()
+		}
+		remote = hop.String()
+	}
+
+	return remote
+}
+
+// hashIP keeps repeated visits recognizable without storing the address itself
+func hashIP(ip string) string {
+	salt := os.Getenv("SCAN_IP_SALT")
+	if salt == "" {
+		salt = string(getJWTSecret())
+	}
+
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// coarseUserAgent only keeps the kind of device and the browser family
+func coarseUserAgent(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+
+	device := "desktop"
+	switch {
+	case strings.Contains(ua, "bot") || strings.Contains(ua, "spider") || strings.Contains(ua, "crawl"):
+		device = "bot"
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet"):
+		device = "tablet"
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "android") || strings.Contains(ua, "iphone"):
+		device = "mobile"
+	}
+
+	// Order matters, most browsers also claim to be Safari or Chrome
+	browser := "other"
+	switch {
+	case strings.Contains(ua, "edg/"):
+		browser = "edge"
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		browser = "opera"
+	case strings.Contains(ua, "samsungbrowser"):
+		browser = "samsung"
+	case strings.Contains(ua, "firefox") || strings.Contains(ua, "fxios"):
+		browser = "firefox"
+	case strings.Contains(ua, "chrome") || strings.Contains(ua, "crios"):
+		browser = "chrome"
+	case strings.Contains(ua, "safari"):
+		browser = "safari"
+	}
+
+	return device + "/" + browser
+}
+
+// scanLocation reads the optional position shared by the finder's browser
+func scanLocation(r *http.Request) (*float64, *float64) {
+	query := r.URL.Query()
+	latitude, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return nil, nil
+	}
+	longitude, err := strconv.ParseFloat(query.Get("lng"), 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return nil, nil
+	}
+
+	return &latitude, &longitude
+}
+
+// scanSource tells how the finder reached the pet: NFC tags add src=nfc to
+// their URL, typed codes come through /t/{code}, anything else is a QR code
+func scanSource(r *http.Request) string {
+	if r.URL.Query().Get("src") == ScanSourceNFC {
+		return ScanSourceNFC
+	}
+	if _, ok := mux.Vars(r)["code"]; ok {
+		return ScanSourceCode
+	}
+
+	return ScanSourceQR
+}
+
+// recordScan saves a scan of the tag and warns the owner, unless the owner is the one looking
+func recordScan(r *http.Request, tag *QRCode, pet *Pet) {
+	if userID, err := currentUserID(r); err == nil && userID == pet.UserID {
+		return
+	}
+
+	scan := ScanEvent{
+		PetID:     pet.ID,
+		TagID:     tag.ID,
+		Source:    scanSource(r),
+		UserAgent: coarseUserAgent(r.UserAgent()),
+		IPHash:    hashIP(clientIP(r)),
+	}
+	scan.Latitude, scan.Longitude = scanLocation(r)
+
+	if err := db.Create(&scan).Error; err != nil {
+		LogErr(r, err)
+		return
+	}
+
+	notifyOwnerOfScan(r, newScanNotification(pet, tag, scan))
+}
+
+// scanHub fans scan notifications out to the open streams of each owner
+type scanHub struct {
+	mu          sync.Mutex
+	subscribers map[uint]map[chan ScanNotification]bool
+}
+
+var scanStreams = &scanHub{subscribers: make(map[uint]map[chan ScanNotification]bool)}
+
+func (h *scanHub) Subscribe(userID uint) chan ScanNotification {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan ScanNotification, 8)
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan ScanNotification]bool)
+	}
+	h.subscribers[userID][ch] = true
+	return ch
+}
+
+func (h *scanHub) Unsubscribe(userID uint, ch chan ScanNotification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers[userID], ch)
+	if len(h.subscribers[userID]) == 0 {
+		delete(h.subscribers, userID)
+	}
+}
+
+// Publish never blocks, a stream too slow to keep up misses the notification
+func (h *scanHub) Publish(userID uint, notification ScanNotification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[userID] {
+		select {
+		case ch <- notification:
+		default:
+		}
+	}
+}
+
+func GetPetScans(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	query := db.Where("pet_id = ?", pet.ID)
+	if source := r.URL.Query().Get("source"); source != "" {
+		query = query.Where("source = ?", source)
+	}
+
+	var scans []ScanEvent
+	query.Order("created_at desc").Limit(maxScanHistory).Find(&scans)
+
+	response := HTTPResponse{
+		Data:   scans,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+// StreamScans pushes the scans of all the user's pets as server-sent events
+func StreamScans(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "-",
+					Error: "Le flux d'événements n'est pas pris en charge",
+				},
+			},
+			Status: http.StatusInternalServerError,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	ch := scanStreams.Subscribe(userID)
+	defer scanStreams.Unsubscribe(userID, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Proxies close idle connections, a comment line keeps the stream alive
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case notification := <-ch:
+			data, err := json.Marshal(notification)
+			if err != nil {
+				LogErr(r, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: scan\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
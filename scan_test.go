@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	previous := trustedProxies
+	defer func() { trustedProxies = previous }()
+
+	tests := []struct {
+		name      string
+		trusted   string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"no proxy configured ignores the header", "", "203.0.113.7:5555", "198.51.100.1", "203.0.113.7"},
+		{"untrusted remote ignores the header", "10.0.0.0/8", "203.0.113.7:5555", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy forwards the client", "10.0.0.0/8", "10.0.0.2:5555", "198.51.100.1", "198.51.100.1"},
+		{"spoofed hops on the left are skipped", "10.0.0.0/8", "10.0.0.2:5555", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"chained trusted proxies are skipped", "10.0.0.0/8,127.0.0.1", "127.0.0.1:5555", "198.51.100.1, 10.0.0.9", "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.0/8", "10.0.0.2:5555", "", "10.0.0.2"},
+		{"garbage in the header stops the walk", "10.0.0.0/8", "10.0.0.2:5555", "198.51.100.1, nope", "10.0.0.2"},
+		{"ipv6 remote", "", "[2001:db8::1]:5555", "198.51.100.1", "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", test.trusted)
+			trustedProxies = loadTrustedProxies()
+
+			r := httptest.NewRequest("GET", "/pet/tag", nil)
+			r.RemoteAddr = test.remote
+			if test.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+
+			if got := clientIP(r); got != test.want {
+				t.Errorf("clientIP = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileStorage keeps uploaded files, local disk being the default backend
+type FileStorage interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// storage is the backend configured at startup
+var storage FileStorage
+
+func loadStorage() FileStorage {
+	dir := os.Getenv("STORAGE_DIR")
+	if dir == "" {
+		dir = "storage"
+	}
+
+	return &localStorage{Dir: dir}
+}
+
+type localStorage struct {
+	Dir string
+}
+
+// path keeps keys inside the storage directory
+func (s *localStorage) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(strings.TrimPrefix(filepath.Clean("/"+key), "/")))
+}
+
+func (s *localStorage) Put(key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o640)
+}
+
+func (s *localStorage) Get(key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+func (s *localStorage) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+)
+
+// Crockford base32: no I, L, O or U so that a code read aloud or typed is unambiguous
+const tagCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// A tag code is made of 7 random symbols followed by a check symbol
+const tagCodeLength = 8
+
+// Symbols often typed in place of the ones of the alphabet
+var tagCodeConfusables = strings.NewReplacer("O", "0", "I", "1", "L", "1", "U", "V", "-", "", " ", "")
+
+// tagCodeChecksum computes the Luhn mod 32 check symbol, which catches any
+// single wrong symbol and most swaps of two adjacent ones
+func tagCodeChecksum(code string) byte {
+	factor, sum := 2, 0
+	for i := len(code) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(tagCodeAlphabet, code[i])
+		factor = 3 - factor
+		sum += addend/len(tagCodeAlphabet) + addend%len(tagCodeAlphabet)
+	}
+
+	return tagCodeAlphabet[(len(tagCodeAlphabet)-sum%len(tagCodeAlphabet))%len(tagCodeAlphabet)]
+}
+
+func newTagCode() (string, error) {
+	random := make([]byte, tagCodeLength-1)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	code := make([]byte, 0, tagCodeLength)
+	for _, b := range random {
+		code = append(code, tagCodeAlphabet[int(b)%len(tagCodeAlphabet)])
+	}
+
+	return string(code) + string(tagCodeChecksum(string(code))), nil
+}
+
+// uniqueTagCode draws codes until one is not used by another tag
+func uniqueTagCode(tx *gorm.DB) (string, error) {
+	for i := 0; i < 5; i++ {
+		code, err := newTagCode()
+		if err != nil {
+			return "", err
+		}
+
+		var count int64
+		if err := tx.Model(&QRCode{}).Where("code = ?", code).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return code, nil
+		}
+	}
+
+	return "", fmt.Errorf("Aucun code de médaille disponible")
+}
+
+// normalizeTagCode upper-cases a typed code, fixes confusable symbols and checks it
+func normalizeTagCode(input string) (string, bool) {
+	code := tagCodeConfusables.Replace(strings.ToUpper(strings.TrimSpace(input)))
+	if len(code) != tagCodeLength {
+		return "", false
+	}
+
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(tagCodeAlphabet, code[i]) < 0 {
+			return "", false
+		}
+	}
+
+	if tagCodeChecksum(code[:tagCodeLength-1]) != code[tagCodeLength-1] {
+		return "", false
+	}
+
+	return code, true
+}
+
+// formatTagCode splits the code in two groups, as it is engraved
+func formatTagCode(code string) string {
+	if len(code) != tagCodeLength {
+		return code
+	}
+
+	return code[:4] + "-" + code[4:]
+}
+
+// backfillTagCodes gives a code to the tags issued before codes existed
+func backfillTagCodes() error {
+	var tags []QRCode
+	if err := db.Unscoped().Where("code IS NULL OR code = ''").Find(&tags).Error; err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		code, err := uniqueTagCode(db)
+		if err != nil {
+			return err
+		}
+		if err := db.Unscoped().Model(&tag).Update("code", code).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetPublicPetByCode is the typed fallback of a QR code that can't be scanned
+func GetPublicPetByCode(w http.ResponseWriter, r *http.Request) {
+	code, ok := normalizeTagCode(mux.Vars(r)["code"])
+	if !ok {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "code",
+					Error: "Ce code n'est pas valide, vérifiez les caractères saisis",
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	tag, pet, status, errors := resolvePublicTagWhere("code", code, "User", "MedicalAlerts")
+	if errors != nil {
+		response := HTTPResponse{
+			Data:   nil,
+			Error:  errors,
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	respondPublicPet(w, r, tag, pet)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	TagStatusActive  = "active"
+	TagStatusRevoked = "revoked"
+)
+
+const (
+	defaultTagLabel = "collar"
+	maxTagLabel     = 30
+)
+
+type TagRequest struct {
+	Label string `json:"label"`
+}
+
+func (tr *TagRequest) Validate() FieldErrors {
+	var fieldErr FieldErrors
+
+	if len(tr.Label) > maxTagLabel {
+		fieldErr = append(fieldErr, FieldError{
+			Field: "label",
+			Error: fmt.Sprintf("Le libellé ne doit pas dépasser %d caractères", maxTagLabel),
+		})
+	}
+
+	return fieldErr
+}
+
+// tagURL is the public address printed on a tag, the stable redirect when QR_BASE_URL is set
+func tagURL(token string) string {
+	if base := os.Getenv("QR_BASE_URL"); base != "" {
+		return stableTagURL(base, token)
+	}
+
+	return publicPetURL(token)
+}
+
+// issueTag creates a new active tag with its own public token
+func issueTag(tx *gorm.DB, petID uint, label string) (QRCode, error) {
+	if label == "" {
+		label = defaultTagLabel
+	}
+
+	code, err := uniqueTagCode(tx)
+	if err != nil {
+		return QRCode{}, err
+	}
+
+	token := uuid.New().String()
+	tag := QRCode{
+		Url:    tagURL(token),
+		PetID:  petID,
+		Token:  token,
+		Code:   code,
+		Label:  label,
+		Status: TagStatusActive,
+	}
+
+	return tag, tx.Create(&tag).Error
+}
+
+// resolvePublicTag finds the pet behind a public tag token.
+// Revoked tags and trashed pets answer 410 Gone, unknown tokens 404.
+func resolvePublicTag(token string, preloads ...string) (*QRCode, *Pet, int, FieldErrors) {
+	return resolvePublicTagWhere("token", token, preloads...)
+}
+
+// resolvePublicTagWhere is resolvePublicTag for any unique column of the tag
+func resolvePublicTagWhere(column string, value string, preloads ...string) (*QRCode, *Pet, int, FieldErrors) {
+	var tag QRCode
+	if err := db.Where(column+" = ?", value).First(&tag).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil, http.StatusNotFound, FieldErrors{{Field: "slug", Error: "Animal introuvable"}}
+		}
+		return nil, nil, http.StatusBadRequest, FieldErrors{{Field: "-", Error: err.Error()}}
+	}
+
+	if tag.Status == TagStatusRevoked {
+		return &tag, nil, http.StatusGone, FieldErrors{{Field: "slug", Error: "Ce QR code a été désactivé par le propriétaire de l'animal"}}
+	}
+
+	query := db.Unscoped()
+	for _, preload := range preloads {
+		query = query.Preload(preload)
+	}
+
+	var pet Pet
+	if err := query.First(&pet, tag.PetID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return &tag, nil, http.StatusNotFound, FieldErrors{{Field: "slug", Error: "Animal introuvable"}}
+		}
+		return &tag, nil, http.StatusBadRequest, FieldErrors{{Field: "-", Error: err.Error()}}
+	}
+
+	if pet.DeletedAt.Valid {
+		return &tag, nil, http.StatusGone, FieldErrors{{Field: "slug", Error: "Cet animal n'est plus référencé"}}
+	}
+
+	return &tag, &pet, http.StatusOK, nil
+}
+
+// petTag finds one of the pet's tags from the {id} route variable
+func petTag(r *http.Request, pet *Pet) (*QRCode, error) {
+	tagID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, err
+	}
+
+	var tag QRCode
+	if err := db.Where("pet_id = ?", pet.ID).First(&tag, tagID).Error; err != nil {
+		return nil, err
+	}
+
+	return &tag, nil
+}
+
+func GetPetTags(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	var tags []QRCode
+	db.Where("pet_id = ?", pet.ID).Order("created_at desc").Find(&tags)
+
+	response := HTTPResponse{
+		Data:   tags,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func CreatePetTag(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	var tagRequest TagRequest
+	if err := json.NewDecoder(r.Body).Decode(&tagRequest); err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusBadRequest,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if errors := tagRequest.Validate(); len(errors) > 0 {
+		response := HTTPResponse{
+			Data:   tagRequest,
+			Error:  errors,
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	tag, err := issueTag(db, pet.ID, tagRequest.Label)
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   tag,
+		Error:  nil,
+		Status: http.StatusCreated,
+	}
+	RespondJson(w, r, response)
+}
+
+func RevokePetTag(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	tag, err := petTag(r, pet)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "QR code introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if tag.Status == TagStatusRevoked {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "status",
+					Error: "Ce QR code est déjà désactivé",
+				},
+			},
+			Status: http.StatusConflict,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		tag.Status = TagStatusRevoked
+		tag.RevokedAt = &now
+		if err := tx.Save(tag).Error; err != nil {
+			return err
+		}
+
+		if pet.QRCodeID != tag.ID {
+			return nil
+		}
+
+		// The newest active tag becomes the main one
+		var next QRCode
+		err := tx.Where("pet_id = ?", pet.ID).Where("status = ?", TagStatusActive).Order("created_at desc").First(&next).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(pet).Update("qr_code_id", next.ID).Error
+	})
+	if err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   tag,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func GetPetTagQRCodePNG(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	tag, err := petTag(r, pet)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "QR code introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	respondQRCode(w, r, tag.Url, "png")
+}
+
+func GetPetTagQRCodeSVG(w http.ResponseWriter, r *http.Request, pet *Pet) {
+	tag, err := petTag(r, pet)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "id",
+					Error: "QR code introuvable",
+				},
+			},
+			Status: http.StatusNotFound,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	respondQRCode(w, r, tag.Url, "svg")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const defaultPetRetentionDays = 30
+
+func GetTrashedPets(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var pets []Pet
+	db.Unscoped().Where("user_id = ?", userID).Where("deleted_at IS NOT NULL").Order("deleted_at desc").Find(&pets)
+
+	response := HTTPResponse{
+		Data:   pets,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func RestorePet(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	petSlug := params["slug"]
+
+	userID, err := currentUserID(r)
+	if err != nil {
+		response := HTTPResponse{
+			Error: FieldErrors{
+				{
+					Field: "jwt",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnauthorized,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	var pet Pet
+	err = db.Unscoped().
+		Where("slug = ?", petSlug).
+		Where("user_id = ?", userID).
+		Where("deleted_at IS NOT NULL").
+		First(&pet).Error
+	if err != nil {
+		var status int
+		if err == gorm.ErrRecordNotFound {
+			status = http.StatusNotFound
+		} else {
+			status = http.StatusBadRequest
+		}
+
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: status,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	if err := db.Unscoped().Model(&pet).Update("deleted_at", nil).Error; err != nil {
+		LogErr(r, err)
+		response := HTTPResponse{
+			Error: FieldErrors{
+				FieldError{
+					Field: "-",
+					Error: err.Error(),
+				},
+			},
+			Status: http.StatusUnprocessableEntity,
+		}
+		RespondJson(w, r, response)
+		return
+	}
+
+	response := HTTPResponse{
+		Data:   pet,
+		Error:  nil,
+		Status: http.StatusOK,
+	}
+	RespondJson(w, r, response)
+}
+
+func petRetentionDays() int {
+	if days, err := strconv.Atoi(os.Getenv("PET_RETENTION_DAYS")); err == nil && days > 0 {
+		return days
+	}
+
+	return defaultPetRetentionDays
+}
+
+// startPetPurgeJob hard-deletes trashed pets once a day
+func startPetPurgeJob() {
+	go func() {
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+
+		for {
+			purged, err := purgeDeletedPets(petRetentionDays())
+			if err != nil {
+				log.Error().Int("Purged", purged).Msg(err.Error())
+			} else if purged > 0 {
+				log.Info().Int("Purged", purged).Msg("Trashed pets purged")
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+// purgeDeletedPets permanently removes pets trashed for more than the given days, with everything they own.
+// On error it still returns how many pets were purged before it.
+func purgeDeletedPets(days int) (int, error) {
+	var pets []Pet
+	deadline := time.Now().AddDate(0, 0, -days)
+	if err := db.Unscoped().Where("deleted_at < ?", deadline).Find(&pets).Error; err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, pet := range pets {
+		var keys []string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			keys, err = purgePet(tx, pet.ID)
+			return err
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged++
+
+		// Files go once the rows are gone for good, a rollback must not leave rows without their file
+		for _, key := range keys {
+			if err := storage.Delete(key); err != nil {
+				log.Error().Str("Key", key).Msg(err.Error())
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// purgePet deletes the rows of the pet and returns the keys of its stored files, to delete after commit
+func purgePet(tx *gorm.DB, petID uint) ([]string, error) {
+	if err := tx.Where("qr_code_id IN (?)", tx.Unscoped().Model(&QRCode{}).Select("id").Where("pet_id = ?", petID)).Delete(&QRCodeRedirect{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Where("pet_id = ?", petID).Delete(&QRCode{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("report_id IN (?)", tx.Model(&Report{}).Select("id").Where("pet_id = ?", petID)).Delete(&NotificationDelivery{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("report_id IN (?)", tx.Model(&Report{}).Select("id").Where("pet_id = ?", petID)).Delete(&ReportStatusEvent{}).Error; err != nil {
+		return nil, err
+	}
+	conversations := tx.Model(&Conversation{}).Select("id").Where("report_id IN (?)", tx.Model(&Report{}).Select("id").Where("pet_id = ?", petID))
+	if err := tx.Where("conversation_id IN (?)", conversations).Delete(&RelayMessage{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("report_id IN (?)", tx.Model(&Report{}).Select("id").Where("pet_id = ?", petID)).Delete(&Conversation{}).Error; err != nil {
+		return nil, err
+	}
+	var photos []ReportPhoto
+	if err := tx.Where("report_id IN (?)", tx.Model(&Report{}).Select("id").Where("pet_id = ?", petID)).Find(&photos).Error; err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, photo := range photos {
+		keys = append(keys, photo.Key)
+	}
+	if err := tx.Where("report_id IN (?)", tx.Model(&Report{}).Select("id").Where("pet_id = ?", petID)).Delete(&ReportPhoto{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("pet_id = ?", petID).Delete(&Report{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("pet_id = ?", petID).Delete(&PetStatusEvent{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("pet_id = ?", petID).Delete(&MedicalAlert{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("pet_id = ?", petID).Delete(&ScanEvent{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("pet_id = ?", petID).Delete(&FoundMatch{}).Error; err != nil {
+		return nil, err
+	}
+
+	return keys, tx.Unscoped().Delete(&Pet{}, petID).Error
+}
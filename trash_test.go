@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrashWithoutBearerToken(t *testing.T) {
+	openTestDB(t, &Pet{})
+	t.Setenv("JWT_SECRET_KEY", "secret")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/pets/trash", GetTrashedPets).Methods("GET")
+	router.HandleFunc("/pets/{slug}/restore", RestorePet).Methods("POST")
+
+	for _, request := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/pets/trash", nil),
+		httptest.NewRequest(http.MethodPost, "/pets/rex/restore", nil),
+	} {
+		request.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, request)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s answered %d, want %d", request.Method, request.URL.Path, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
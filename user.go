@@ -13,6 +13,8 @@ type User struct {
 	Password  string `gorm:"type:varchar(100)" json:"password"`
 	Name      string `gorm:"type:varchar(40)" json:"name"`
 	Firstname string `gorm:"type:varchar(25)" json:"firstname"`
+	Phone     string `gorm:"type:varchar(20)" json:"phone"`
+	IsAdmin   bool   `json:"-"`
 }
 
 type UserRes struct {
@@ -20,6 +22,7 @@ type UserRes struct {
 	Email     string `json:"email"`
 	Name      string `json:"name"`
 	Firstname string `json:"firstname"`
+	Phone     string `json:"phone"`
 }
 
 func (u *User) validPassword(hash string) bool {
@@ -228,6 +231,7 @@ func GetUser(w http.ResponseWriter, r *http.Request) {
 		Email:     user.Email,
 		Name:      user.Name,
 		Firstname: user.Firstname,
+		Phone:     user.Phone,
 	}
 
 	response := HTTPResponse{